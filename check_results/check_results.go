@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
 	"path/filepath"
 	"time"
@@ -19,8 +22,16 @@ type config struct {
 	VerifySSL           bool
 	PrefetchCount       int
 	WaitBetweenRequests int
+	AllowedCuckoos      []string
+	HTTP                *lib.HTTPConfig
+	MonitorAddr         string
+	Tracing             *lib.TraceConfig
+	Security            *lib.SecurityConfig
 	LogFile             string
 	LogLevel            string
+	LogFormat           string
+	LogMaxSize          int
+	LogMaxBackups       int
 }
 
 type watchElem struct {
@@ -33,6 +44,7 @@ var (
 	producer *lib.QueueHandler
 	wbr      int
 	watchMap = make(map[string]*watchElem)
+	watched  *lib.Gauge
 )
 
 func main() {
@@ -54,7 +66,13 @@ func main() {
 	}
 
 	// setup
-	c = lib.Init("check_results", conf.Amqp, conf.LogFile, conf.LogLevel, conf.FailedQueue, conf.VerifySSL)
+	c = lib.Init("check_results", conf.Amqp, &lib.LogConfig{conf.LogFile, conf.LogLevel, conf.LogFormat, conf.LogMaxSize, conf.LogMaxBackups}, conf.FailedQueue, conf.VerifySSL)
+	c.SetupTracing(conf.Tracing)
+	c.SetupSecurity(conf.Security)
+	c.SetupHTTP(conf.HTTP)
+	c.AllowCuckooURLs(conf.AllowedCuckoos)
+	watched = c.Metrics.NewGauge("check_results_watched_tasks", "Cuckoo tasks waiting for their report.")
+	c.StartMonitor(conf.MonitorAddr)
 	wbr = conf.WaitBetweenRequests
 	producer = c.SetupQueue(conf.ProducerQueue)
 
@@ -67,18 +85,19 @@ func main() {
 // added to the watchMap.
 func parseMsg(msg amqp.Delivery) {
 	m := &lib.FeedCuckooReq{}
-	err := json.Unmarshal(msg.Body, m)
-	if c.NackOnError(err, "Could not decode json!", &msg) {
+	_, err := lib.OpenEnvelope(msg.Body, lib.MsgTypeFeedCuckoo, m)
+	if c.NackWithCode(err, lib.ErrMalformed, "Could not decode msg!", &msg) {
 		return
 	}
 
-	if c.NackOnError(m.Validate(), "Error in msg from feed_cuckoo service!", &msg) {
+	if c.NackWithCode(m.Validate(), lib.ErrMalformed, "Error in msg from feed_cuckoo service!", &msg) {
 		return
 	}
 
 	// add to the monitoring map
 	// TODO: make sure crits analysis_id is really unique
 	watchMap[m.CritsData.AnalysisId] = &watchElem{Req: m, Msg: &msg}
+	watched.Set(float64(len(watchMap)))
 }
 
 // checkLoop loops over the watch map and checks if Cuckko is done
@@ -91,11 +110,27 @@ func checkLoop() {
 		for k, v := range watchMap {
 			time.Sleep(waitDuration)
 
-			cuckoo := c.NewCuckoo(v.Req.CuckooURL)
+			c := c.WithMsg(v.Msg, v.Req.CritsData, v.Req.TaskId, v.Req.CuckooURL)
+
+			cuckoo, err := c.NewCuckoo(v.Req.CuckooURL)
+			if c.NackWithCode(err, lib.ErrNotAllowed, "Message references a cuckoo instance which is not allowed!", v.Msg) {
+				delete(watchMap, k)
+				watched.Set(float64(len(watchMap)))
+				continue
+			}
+
 			status, err := cuckoo.TaskStatus(v.Req.TaskId)
 
-			if c.NackOnError(err, "Couldn't get cuckoo status of task!", v.Msg) {
+			if c.NackWithCode(err, lib.ErrCuckoo, "Couldn't get cuckoo status of task!", v.Msg) {
 				delete(watchMap, k)
+				watched.Set(float64(len(watchMap)))
+				continue
+			}
+
+			if lib.TaskFailed(status) {
+				failTask(c, cuckoo, v)
+				delete(watchMap, k)
+				watched.Set(float64(len(watchMap)))
 				continue
 			}
 
@@ -103,22 +138,54 @@ func checkLoop() {
 				continue
 			}
 
-			crMsg, err := json.Marshal(lib.CheckResultsReq{
+			crMsg, err := c.NextEnvelope(v.Msg, lib.MsgTypeCheckResults, &lib.CheckResultsReq{
 				v.Req.CuckooURL,
 				v.Req.TaskId,
 				v.Req.CritsData,
+				v.Req.Payload,
 			})
 			if c.NackOnError(err, "Could not create CheckResultsReq!", v.Msg) {
 				delete(watchMap, k)
+				watched.Set(float64(len(watchMap)))
 				continue
 			}
 
-			producer.Send(crMsg)
-			if err := v.Msg.Ack(false); err != nil {
-				c.Warning.Println("Sending ACK failed!", err.Error())
-			}
+			producer.For(c).Forward(crMsg, v.Msg)
+			c.Ack(v.Msg)
 
 			delete(watchMap, k)
+			watched.Set(float64(len(watchMap)))
 		}
 	}
 }
+
+// failTask sends a msg whose cuckoo task failed to the overseer.
+// The sample is downloaded from cuckoo, so the overseer can restart
+// the analysis at feed_cuckoo.
+func failTask(c *lib.Core, cuckoo *lib.CuckooConn, v *watchElem) {
+	taskErr := errors.New(fmt.Sprintf("cuckoo task %d failed", v.Req.TaskId))
+
+	name, data, err := cuckoo.TaskSample(v.Req.TaskId)
+	if err != nil {
+		c.Warning.Println("Couldn't download the sample of the failed task!", err)
+		c.NackWithCode(taskErr, lib.ErrTaskFailed, "Cuckoo task failed!", v.Msg)
+		return
+	}
+
+	// crits options are passed on again, feed_cuckoo
+	// separates them from the cuckoo options. The attempt is
+	// kept, so a sample which always fails is eventually dumped.
+	restart, err := c.NextEnvelope(v.Msg, lib.MsgTypeDistributedCuckoo, &lib.DistributedCuckooReq{
+		v.Req.Payload,
+		map[string]string{
+			"name": name,
+			"data": base64.StdEncoding.EncodeToString(data),
+		},
+		v.Req.CritsData,
+	})
+	if c.NackOnError(err, "Could not create DistributedCuckooReq!", v.Msg) {
+		return
+	}
+
+	c.NackRestart(taskErr, lib.ErrTaskFailed, "feed_cuckoo", restart, "Cuckoo task failed!", v.Msg)
+}
@@ -1,5 +1,11 @@
 import logging
 import base64
+import uuid
+import datetime
+import json
+import hmac
+import hashlib
+import os
 
 from django.conf import settings
 from django.template.loader import render_to_string
@@ -63,8 +69,10 @@ class CuckooDistributedService(Service):
             raise ServiceConfigError("Password required.")
         if not config['rabbit_key']:
             raise ServiceConfigError("Key required.")
-        if not config['crits_api_key']:
-            raise ServiceConfigError("API key required.")
+        if config.get('signing_key') and not config.get('signing_key_id'):
+            raise ServiceConfigError("Signing key id required.")
+        if config.get('encryption_key') and not config.get('encryption_key_id'):
+            raise ServiceConfigError("Encryption key id required.")
 
     @classmethod
     def generate_config_form(self, config):
@@ -104,12 +112,21 @@ class CuckooDistributedService(Service):
                 'object_type': obj._meta['crits_type'],
                 'object_id': str(obj.id),
                 'username': self.current_task.username,
-                'api_key': config['crits_api_key'],
                 'md5': str(self.obj.md5),
                 'source': self.obj.source[0].name
             }
         }
 
+        # see "Messages" in the README
+        envelope = {
+            'type': 'distributed_cuckoo_req',
+            'schema_version': 3,
+            'message_id': uuid.uuid4().hex,
+            'created_at': datetime.datetime.utcnow().isoformat() + 'Z',
+            'attempt': 0,
+            'payload': msg
+        }
+
         rabbit_exch = config.get("rabbit_exch", "")
         routing_key = config['rabbit_key']
         """
@@ -123,11 +140,35 @@ class CuckooDistributedService(Service):
         """
         rabbit_url = "amqp://"+config['rabbit_user']+':'+config['rabbit_pw']+'@'+config['rabbit_address']+':'+config['rabbit_port']
         
+        body = json.dumps(envelope)
+        headers = {}
+
         try:
-            from crits.services.connector import Connector
-            conn = Connector(connector="amqp", uri=rabbit_url, ssl=False)
-            conn.send_msg(msg, rabbit_exch, routing_key)
-            conn.release()
+            # see "Message security" in the README
+            if config.get('encryption_key'):
+                from cryptography.hazmat.primitives.ciphers.aead import AESGCM
+                nonce = os.urandom(12)
+                aesgcm = AESGCM(base64.b64decode(config['encryption_key']))
+                body = nonce + aesgcm.encrypt(nonce, body, routing_key)
+                headers['x-encryption-key'] = config['encryption_key_id']
+
+            if config.get('signing_key'):
+                mac = hmac.new(base64.b64decode(config['signing_key']),
+                               routing_key + '\n' + body, hashlib.sha256)
+                headers['x-signature-key'] = config['signing_key_id']
+                headers['x-signature'] = base64.b64encode(mac.digest())
+
+            # the connector of crits can't set headers
+            from kombu import Connection
+            with Connection(rabbit_url) as conn:
+                producer = conn.Producer()
+                producer.publish(body,
+                                 exchange=rabbit_exch,
+                                 routing_key=routing_key,
+                                 headers=headers,
+                                 content_type='text/plain',
+                                 content_encoding='binary',
+                                 delivery_mode=2)
         except Exception as e:
             self._error("Distribution error: {}".format(e))
             return None
@@ -38,11 +38,26 @@ class CuckooDistributedConfigForm(forms.Form):
                           widget=forms.TextInput(),
                           initial='',
                           help_text="Exchange for the RabbitMQ Server, leave empty for none")
-    crits_api_key = forms.CharField(required=True,
-                          label="CRITS api key",
+    signing_key_id = forms.CharField(required=False,
+                          label="Signing key id",
                           widget=forms.TextInput(),
                           initial='',
-                          help_text="The CRITS api key of the executing user.")
+                          help_text="Id of the signing key as set in SigningKeys of the services")
+    signing_key = forms.CharField(required=False,
+                          label="Signing key",
+                          widget=forms.PasswordInput(render_value=True),
+                          initial='',
+                          help_text="Base64 encoded HMAC-SHA256 key, leave empty to send unsigned messages")
+    encryption_key_id = forms.CharField(required=False,
+                          label="Encryption key id",
+                          widget=forms.TextInput(),
+                          initial='',
+                          help_text="Id of the encryption key as set in EncryptionKeys of the services")
+    encryption_key = forms.CharField(required=False,
+                          label="Encryption key",
+                          widget=forms.PasswordInput(render_value=True),
+                          initial='',
+                          help_text="Base64 encoded AES key, leave empty to send plain text messages")
   
     def __init__(self, *args, **kwargs):
         super(CuckooDistributedConfigForm, self).__init__(*args, **kwargs)
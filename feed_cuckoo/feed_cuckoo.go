@@ -6,6 +6,7 @@ import (
 	"flag"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/cynexit/cuckoo_distributed/lib"
@@ -22,8 +23,15 @@ type config struct {
 	CuckooURL      string
 	PrefetchCount  int
 	MaxPending     int
+	HTTP           *lib.HTTPConfig
+	MonitorAddr    string
+	Tracing        *lib.TraceConfig
+	Security       *lib.SecurityConfig
 	LogFile        string
 	LogLevel       string
+	LogFormat      string
+	LogMaxSize     int
+	LogMaxBackups  int
 }
 
 var (
@@ -32,6 +40,8 @@ var (
 	producer       *lib.QueueHandler
 	checkFreeSpace bool
 	maxPending     = 0
+	pendingTasks   *lib.Gauge
+	freeSpace      *lib.Gauge
 )
 
 func main() {
@@ -53,10 +63,20 @@ func main() {
 	}
 
 	// setup
-	c = lib.Init("feed_cuckoo", conf.Amqp, conf.LogFile, conf.LogLevel, conf.FailedQueue, conf.VerifySSL)
+	c = lib.Init("feed_cuckoo", conf.Amqp, &lib.LogConfig{conf.LogFile, conf.LogLevel, conf.LogFormat, conf.LogMaxSize, conf.LogMaxBackups}, conf.FailedQueue, conf.VerifySSL)
+	c.SetupTracing(conf.Tracing)
+	c.SetupSecurity(conf.Security)
+	c.SetupHTTP(conf.HTTP)
+	pendingTasks = c.Metrics.NewGauge("feed_cuckoo_pending_tasks", "Pending tasks of cuckoo at the last check.", "cuckoo")
+	freeSpace = c.Metrics.NewGauge("feed_cuckoo_free_space_bytes", "Free space for analyses of cuckoo at the last check.", "cuckoo")
 	checkFreeSpace = conf.CheckFreeSpace
 	maxPending = conf.MaxPending
-	cuckoo = c.NewCuckoo(conf.CuckooURL)
+	cuckoo, err = c.NewCuckoo(conf.CuckooURL)
+	c.FailOnError(err, "Invalid CuckooURL!")
+	c.AddReadyCheck("cuckoo", func() (interface{}, error) {
+		return cuckoo.URL, c.Reachable(cuckoo.URL + "/cuckoo/status")
+	})
+	c.StartMonitor(conf.MonitorAddr)
 	producer = c.SetupQueue(conf.ProducerQueue)
 	c.Consume(conf.ConsumerQueue, conf.PrefetchCount, parseMsg)
 }
@@ -66,17 +86,21 @@ func main() {
 // send to handleSubmit.
 func parseMsg(msg amqp.Delivery) {
 	m := &lib.DistributedCuckooReq{}
-	err := json.Unmarshal(msg.Body, m)
-	if c.NackOnError(err, "Could not decode json!", &msg) {
+	_, err := lib.OpenEnvelope(msg.Body, lib.MsgTypeDistributedCuckoo, m)
+	if c.NackWithCode(err, lib.ErrMalformed, "Could not decode msg!", &msg) {
 		return
 	}
 
-	if c.NackOnError(m.Validate(), "Error in msg from Crits service!", &msg) {
+	if c.NackWithCode(m.Validate(), lib.ErrMalformed, "Error in msg from Crits service!", &msg) {
 		return
 	}
 
+	// older versions of the crits service still send the api key,
+	// it must not be passed through the other queues.
+	m.CritsData.ApiKey = ""
+
 	fileBytes, err := base64.StdEncoding.DecodeString(m.File["data"])
-	if c.NackOnError(err, "Couldn't decode msg!", &msg) {
+	if c.NackWithCode(err, lib.ErrMalformed, "Couldn't decode msg!", &msg) {
 		return
 	}
 
@@ -90,7 +114,15 @@ func parseMsg(msg amqp.Delivery) {
 // cuckoo. On success the information is passed to the
 // check_results queue.
 func handleSubmit(m *lib.DistributedCuckooReq, fileBytes []byte, msg *amqp.Delivery) {
+	c := c.WithMsg(msg, m.CritsData, 0, cuckoo.URL)
+	// requests to cuckoo are part of the trace of the message
+	cuckoo, err := c.NewCuckoo(cuckoo.URL)
+	if c.NackWithCode(err, lib.ErrNotAllowed, "Invalid cuckoo URL!", msg) {
+		return
+	}
+
 	cStatus, _ := cuckoo.GetStatus()
+	recordStatus(cStatus)
 
 	// check if cuckoo is on it's limit
 	// wait if there are to much pending jobs OR the free discspace is below 256MB
@@ -98,24 +130,44 @@ func handleSubmit(m *lib.DistributedCuckooReq, fileBytes []byte, msg *amqp.Deliv
 		c.Info.Printf("Slowdown: %d pending jobs, %d MB free space\n", cStatus.Tasks.Pending, (cStatus.Diskspace.Analyses.Free / 1024 / 1024))
 		time.Sleep(time.Second * 30)
 		cStatus, _ = cuckoo.GetStatus()
+		recordStatus(cStatus)
 	}
 
-	id, err := cuckoo.NewTask(fileBytes, m.File["name"], m.Payload)
-	if c.NackOnError(err, "Uploading sample to cuckoo failed!", msg) {
+	// options for crits are passed on to parse_and_submit
+	// while everything else is meant for cuckoo
+	params := make(map[string]string)
+	for k, v := range m.Payload {
+		if !strings.HasPrefix(k, "crits_") {
+			params[k] = v
+		}
+	}
+
+	id, err := cuckoo.NewTask(fileBytes, m.File["name"], params)
+	if c.NackWithCode(err, lib.ErrCuckoo, "Uploading sample to cuckoo failed!", msg) {
 		return
 	}
+	c = c.With(lib.Fields{"task_id": id})
 
-	fcReq, err := json.Marshal(lib.FeedCuckooReq{
+	fcReq, err := c.NextEnvelope(msg, lib.MsgTypeFeedCuckoo, &lib.FeedCuckooReq{
 		id,
 		cuckoo.URL,
 		m.CritsData,
+		m.Payload,
 	})
 	if c.NackOnError(err, "Could not create feedCuckooReq!", msg) {
 		return
 	}
 
-	producer.Send(fcReq)
-	if err := msg.Ack(false); err != nil {
-		c.Warning.Println("Sending ACK failed!", err.Error())
+	producer.For(c).Forward(fcReq, msg)
+	c.Ack(msg)
+}
+
+// recordStatus updates the metrics with the status of cuckoo.
+func recordStatus(s *lib.CkoStatus) {
+	if s == nil {
+		return
 	}
+
+	pendingTasks.Set(float64(s.Tasks.Pending), cuckoo.URL)
+	freeSpace.Set(float64(s.Diskspace.Analyses.Free), cuckoo.URL)
 }
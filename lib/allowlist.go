@@ -0,0 +1,97 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// allowList holds the base URLs of the crits or cuckoo instances a
+// service may talk to. A nil allowList allows every URL.
+type allowList struct {
+	kind  string
+	bases []*url.URL
+}
+
+// AllowCritsURLs restricts the crits instances named in messages
+// to the given base URLs, NewCrits fails for every other URL.
+func (c *Core) AllowCritsURLs(URLs []string) {
+	c.critsAllowed = c.newAllowList("crits", URLs)
+}
+
+// AllowCuckooURLs restricts the cuckoo instances named in messages
+// to the given base URLs, NewCuckoo fails for every other URL.
+func (c *Core) AllowCuckooURLs(URLs []string) {
+	c.cuckooAllowed = c.newAllowList("cuckoo", URLs)
+}
+
+func (c *Core) newAllowList(kind string, URLs []string) *allowList {
+	if len(URLs) == 0 {
+		c.Warning.Printf("No %s URLs allowed explicitly, every %s URL found in a message will be used!\n", kind, kind)
+		return nil
+	}
+
+	l := &allowList{kind: kind}
+	for _, u := range URLs {
+		base, err := parseEndpoint(u)
+		c.FailOnError(err, fmt.Sprintf("Invalid allowed %s URL %s", kind, u))
+
+		l.bases = append(l.bases, base)
+	}
+
+	return l
+}
+
+// parseEndpoint parses an http(s) URL without credentials, query,
+// or fragment.
+func parseEndpoint(URL string) (*url.URL, error) {
+	u, err := url.Parse(URL)
+	if err != nil {
+		return nil, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("scheme has to be http or https")
+	}
+	if u.Host == "" {
+		return nil, errors.New("no host")
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, errors.New("credentials, query, and fragment aren't allowed")
+	}
+	for _, segment := range strings.Split(u.Path, "/") {
+		if segment == "." || segment == ".." {
+			return nil, errors.New("relative path segments aren't allowed")
+		}
+	}
+
+	u.Host = strings.ToLower(u.Host)
+	u.Path = strings.TrimRight(u.Path, "/")
+	return u, nil
+}
+
+// check returns an error unless URL is one of the allowed base URLs
+// or a path below one of them.
+func (l *allowList) check(URL string) error {
+	if l == nil {
+		return nil
+	}
+
+	u, err := parseEndpoint(URL)
+	if err != nil {
+		return errors.New(fmt.Sprintf("invalid %s URL %q: %s", l.kind, URL, err))
+	}
+
+	for _, base := range l.bases {
+		if u.Scheme != base.Scheme || u.Host != base.Host {
+			continue
+		}
+
+		if u.Path == base.Path || strings.HasPrefix(u.Path, base.Path+"/") {
+			return nil
+		}
+	}
+
+	return errors.New(fmt.Sprintf("%s URL %q is not allowed", l.kind, URL))
+}
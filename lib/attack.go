@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// AttackMapping maps cuckoo signatures to MITRE ATT&CK techniques.
+// The mapping is read from a JSON file which is reloaded as soon as
+// it changes on disk so it can be maintained without a restart.
+type AttackMapping struct {
+	path    string
+	modTime time.Time
+	mutex   *sync.Mutex
+	data    *attackMappingFile
+}
+
+// AttackTechnique is a single ATT&CK technique (or sub technique).
+type AttackTechnique struct {
+	Id      string   `json:"-"`
+	Name    string   `json:"name"`
+	Tactics []string `json:"tactics"`
+}
+
+type attackMappingFile struct {
+	// Techniques contains all known techniques keyed by their id.
+	Techniques map[string]*AttackTechnique `json:"techniques"`
+
+	// Signatures maps signature names to technique ids.
+	Signatures map[string][]string `json:"signatures"`
+}
+
+// LoadAttackMapping reads the mapping file at path.
+func LoadAttackMapping(path string) (*AttackMapping, error) {
+	m := &AttackMapping{
+		path:  path,
+		mutex: &sync.Mutex{},
+	}
+
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func (m *AttackMapping) load() error {
+	stat, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+
+	fp, err := os.Open(m.path)
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+
+	data := &attackMappingFile{}
+	if err = json.NewDecoder(fp).Decode(data); err != nil {
+		return err
+	}
+
+	for id, t := range data.Techniques {
+		t.Id = id
+	}
+
+	m.data = data
+	m.modTime = stat.ModTime()
+
+	return nil
+}
+
+// reloadIfChanged reloads the mapping if the file was modified. If
+// the new file is broken the old mapping is kept.
+func (m *AttackMapping) reloadIfChanged() error {
+	stat, err := os.Stat(m.path)
+	if err != nil {
+		return err
+	}
+
+	if stat.ModTime().Equal(m.modTime) {
+		return nil
+	}
+
+	return m.load()
+}
+
+// Lookup returns the techniques for a signature. Both the technique
+// ids supplied by cuckoo (ttp) and the ids from the mapping file
+// are used. Ids unknown to the mapping file are returned without
+// name and tactics.
+func (m *AttackMapping) Lookup(sig *CkoTasksReportSignature) ([]*AttackTechnique, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	reloadErr := m.reloadIfChanged()
+
+	ids := append(sig.TTPIds(), m.data.Signatures[sig.Name]...)
+
+	techniques := []*AttackTechnique{}
+	seen := make(map[string]bool)
+
+	for _, id := range ids {
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		t, known := m.data.Techniques[id]
+		if !known {
+			t = &AttackTechnique{Id: id}
+		}
+
+		techniques = append(techniques, t)
+	}
+
+	return techniques, reloadErr
+}
@@ -0,0 +1,174 @@
+package lib
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testAttackMapping = `{
+	"techniques": {
+		"T1055": {"name": "Process Injection", "tactics": ["defense-evasion", "privilege-escalation"]},
+		"T1112": {"name": "Modify Registry", "tactics": ["defense-evasion"]}
+	},
+	"signatures": {
+		"injection_createremotethread": ["T1055"],
+		"persistence_autorun": ["T1112", "T1547.001"]
+	}
+}`
+
+// writeAttackMapping writes content to path and moves its
+// modification time forward, so the change is always noticed.
+func writeAttackMapping(t *testing.T, path, content string, age time.Duration) {
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	modTime := time.Now().Add(-age)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testAttackMappingFile(t *testing.T) (*AttackMapping, string, func()) {
+	dir, err := ioutil.TempDir("", "attack")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "attack_mapping.json")
+	writeAttackMapping(t, path, testAttackMapping, time.Hour)
+
+	m, err := LoadAttackMapping(path)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return m, path, func() { os.RemoveAll(dir) }
+}
+
+func techniqueIds(techniques []*AttackTechnique) []string {
+	ids := []string{}
+	for _, t := range techniques {
+		ids = append(ids, t.Id)
+	}
+
+	return ids
+}
+
+func TestAttackLookup(t *testing.T) {
+	m, _, cleanup := testAttackMappingFile(t)
+	defer cleanup()
+
+	tests := []struct {
+		name string
+		ttp  string
+		want []string
+	}{
+		{"injection_createremotethread", ``, []string{"T1055"}},
+		{"persistence_autorun", ``, []string{"T1112", "T1547.001"}},
+		{"unknown", ``, []string{}},
+
+		// ids from cuckoo come first, duplicates are dropped
+		{"injection_createremotethread", `["T1112", "T1055"]`, []string{"T1112", "T1055"}},
+		{"unknown", `{"T1082": {}}`, []string{"T1082"}},
+	}
+
+	for _, tt := range tests {
+		sig := &CkoTasksReportSignature{Name: tt.name, TTP: json.RawMessage(tt.ttp)}
+		techniques, err := m.Lookup(sig)
+		if err != nil {
+			t.Fatalf("Lookup(%s, %s) failed: %s", tt.name, tt.ttp, err)
+		}
+
+		if ids := techniqueIds(techniques); !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("Lookup(%s, %s) = %v, want %v", tt.name, tt.ttp, ids, tt.want)
+		}
+	}
+}
+
+func TestAttackLookupTechniques(t *testing.T) {
+	m, _, cleanup := testAttackMappingFile(t)
+	defer cleanup()
+
+	techniques, _ := m.Lookup(&CkoTasksReportSignature{Name: "persistence_autorun"})
+	if len(techniques) != 2 {
+		t.Fatalf("Lookup = %v", techniqueIds(techniques))
+	}
+
+	known := techniques[0]
+	if known.Id != "T1112" || known.Name != "Modify Registry" || !reflect.DeepEqual(known.Tactics, []string{"defense-evasion"}) {
+		t.Errorf("known technique = %+v", known)
+	}
+
+	// ids missing in the techniques are returned as they are
+	unknown := techniques[1]
+	if unknown.Id != "T1547.001" || unknown.Name != "" || unknown.Tactics != nil {
+		t.Errorf("unknown technique = %+v", unknown)
+	}
+}
+
+func TestAttackReload(t *testing.T) {
+	m, path, cleanup := testAttackMappingFile(t)
+	defer cleanup()
+
+	sig := &CkoTasksReportSignature{Name: "injection_createremotethread"}
+
+	writeAttackMapping(t, path, `{"signatures": {"injection_createremotethread": ["T1055.012"]}}`, 0)
+	techniques, err := m.Lookup(sig)
+	if err != nil || !reflect.DeepEqual(techniqueIds(techniques), []string{"T1055.012"}) {
+		t.Errorf("Lookup after change = %v, %v", techniqueIds(techniques), err)
+	}
+
+	// a broken file keeps the last mapping
+	writeAttackMapping(t, path, `{"signatures": `, -time.Hour)
+	techniques, err = m.Lookup(sig)
+	if err == nil || !reflect.DeepEqual(techniqueIds(techniques), []string{"T1055.012"}) {
+		t.Errorf("Lookup after broken change = %v, %v", techniqueIds(techniques), err)
+	}
+
+	os.Remove(path)
+	techniques, err = m.Lookup(sig)
+	if err == nil || !reflect.DeepEqual(techniqueIds(techniques), []string{"T1055.012"}) {
+		t.Errorf("Lookup after removal = %v, %v", techniqueIds(techniques), err)
+	}
+}
+
+func TestLoadAttackMappingFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "attack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	broken := filepath.Join(dir, "broken.json")
+	writeAttackMapping(t, broken, `{"techniques": []}`, 0)
+
+	for _, path := range []string{filepath.Join(dir, "missing.json"), broken} {
+		if _, err := LoadAttackMapping(path); err == nil {
+			t.Errorf("LoadAttackMapping(%s) succeeded", path)
+		}
+	}
+}
+
+// The mapping shipped with parse_and_submit has to load and only
+// map signatures to techniques it describes.
+func TestBundledAttackMapping(t *testing.T) {
+	m, err := LoadAttackMapping("../parse_and_submit/attack_mapping.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, ids := range m.data.Signatures {
+		for _, id := range ids {
+			if _, known := m.data.Techniques[id]; !known {
+				t.Errorf("signature %s maps to unknown technique %s", name, id)
+			}
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// CredentialsConfig configures where the crits api keys are taken
+// from. Messages only name the user, the key is resolved locally.
+type CredentialsConfig struct {
+	File           string // credentials file, a JSON list of Credentials
+	ServiceAccount string // user of the file used for users without an entry
+}
+
+// Credential is an entry of the credentials file. An empty CritsURL
+// matches every crits instance.
+type Credential struct {
+	CritsURL string `json:"crits_url"`
+	Username string `json:"username"`
+	ApiKey   string `json:"api_key"`
+}
+
+type credentialKey struct {
+	URL      string
+	Username string
+}
+
+type credentials struct {
+	entries        map[credentialKey]*Credential
+	serviceAccount string
+}
+
+// SetupCredentials reads the credentials file set in conf. Without
+// credentials only legacy messages still carrying an api key can be
+// sent to crits.
+func (c *Core) SetupCredentials(conf *CredentialsConfig) {
+	if conf == nil || conf.File == "" {
+		c.Warning.Println("No credentials file set, only messages containing an api key can be handled!")
+		return
+	}
+
+	f, err := os.Open(conf.File)
+	c.FailOnError(err, "Couldn't open the credentials file!")
+	defer f.Close()
+
+	info, err := f.Stat()
+	c.FailOnError(err, "Couldn't stat the credentials file!")
+	if info.Mode().Perm()&0077 != 0 {
+		c.Warning.Printf("The credentials file %s is readable by other users (%s)!\n", conf.File, info.Mode().Perm())
+	}
+
+	list := []*Credential{}
+	err = json.NewDecoder(f).Decode(&list)
+	c.FailOnError(err, "Couldn't decode the credentials file!")
+
+	creds := &credentials{
+		entries:        make(map[credentialKey]*Credential),
+		serviceAccount: conf.ServiceAccount,
+	}
+	for _, cred := range list {
+		if cred.Username == "" || cred.ApiKey == "" {
+			c.FailOnError(errors.New("entry without username or api_key"), "Couldn't load the credentials file!")
+		}
+
+		creds.entries[credentialKey{strings.TrimRight(cred.CritsURL, "/"), cred.Username}] = cred
+	}
+
+	if creds.serviceAccount != "" && !creds.has(creds.serviceAccount) {
+		c.FailOnError(errors.New(fmt.Sprintf("no entry for service account %s", creds.serviceAccount)), "Couldn't load the credentials file!")
+	}
+
+	c.credentials = creds
+	c.Info.Printf("Loaded %d credentials from %s\n", len(list), conf.File)
+}
+
+// has checks if the file contains an entry for user.
+func (cr *credentials) has(user string) bool {
+	for k := range cr.entries {
+		if k.Username == user {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookup returns the entry of user for the given crits instance,
+// entries for a specific instance take precedence.
+func (cr *credentials) lookup(URL, user string) *Credential {
+	if cred, exists := cr.entries[credentialKey{strings.TrimRight(URL, "/"), user}]; exists {
+		return cred
+	}
+
+	return cr.entries[credentialKey{"", user}]
+}
+
+// CritsCredential returns the credential used to talk to crits on
+// behalf of the user of data: the user's own entry, the service
+// account, or, for messages sent before the keys were removed from
+// the queues, the key contained in data.
+func (c *Core) CritsCredential(data *CritsData) (*Credential, error) {
+	if cr := c.credentials; cr != nil {
+		if cred := cr.lookup(data.CritsURL, data.Username); cred != nil {
+			return cred, nil
+		}
+
+		if cr.serviceAccount != "" {
+			if cred := cr.lookup(data.CritsURL, cr.serviceAccount); cred != nil {
+				return cred, nil
+			}
+		}
+	}
+
+	if data.ApiKey != "" {
+		return &Credential{data.CritsURL, data.Username, data.ApiKey}, nil
+	}
+
+	return nil, errors.New(fmt.Sprintf("no credentials for user %s of %s", data.Username, data.CritsURL))
+}
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -10,6 +11,7 @@ import (
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -17,8 +19,23 @@ type CritsConn struct {
 	C    *Core
 	URL  string
 	Data *CritsData
+
+	// Results are sent to crits in chunks of at most ChunkResults
+	// results and ChunkBytes bytes.
+	ChunkResults int
+	ChunkBytes   int
+
+	limiter  *RateLimiter
+	username string
+	apiKey   string
 }
 
+// Default chunk limits of a new CritsConn.
+const (
+	DefaultChunkResults = 500
+	DefaultChunkBytes   = 1024 * 1024
+)
+
 type CrtDefaultResponse struct {
 	ReturnCode int    `json:"return_code"`
 	ErrorMsg   string `json:"error_message"`
@@ -33,12 +50,31 @@ type CrtResult struct {
 	Data    map[string]interface{}
 }
 
-func (c *Core) NewCrits(Data *CritsData) *CritsConn {
-	return &CritsConn{
-		C:    c,
-		URL:  Data.CritsURL,
-		Data: Data,
+// NewCrits returns a connection to the crits instance of Data. It
+// fails if the instance isn't allowed or there are no credentials
+// for the user.
+func (c *Core) NewCrits(Data *CritsData) (*CritsConn, error) {
+	// checked first so unknown instances don't end up in the
+	// rate limiters and ready checks
+	if err := c.critsAllowed.check(Data.CritsURL); err != nil {
+		return nil, err
 	}
+
+	cred, err := c.CritsCredential(Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &CritsConn{
+		C:            c,
+		URL:          Data.CritsURL,
+		Data:         Data,
+		ChunkResults: DefaultChunkResults,
+		ChunkBytes:   DefaultChunkBytes,
+		limiter:      c.RateLimiter(Data.CritsURL),
+		username:     cred.Username,
+		apiKey:       cred.ApiKey,
+	}, nil
 }
 
 func (crt *CritsConn) Log(level, msg string) error {
@@ -48,11 +84,14 @@ func (crt *CritsConn) Log(level, msg string) error {
 	data.Add("analysis_id", crt.Data.AnalysisId)
 	data.Add("object_type", crt.Data.ObjectType)
 	data.Add("object_id", crt.Data.ObjectId)
-	data.Add("username", crt.Data.Username)
-	data.Add("api_key", crt.Data.ApiKey)
+	data.Add("username", crt.username)
+	data.Add("api_key", crt.apiKey)
 
 	r := &CrtDefaultResponse{}
-	resp, status, err := crt.C.FastPostForm(crt.URL, data, r)
+	// every request to crits has to wait for the rate limiter
+	// which is shared by all connections to the same instance.
+	defer crt.limiter.Acquire()()
+	resp, status, err := crt.C.FastPostForm(crt.URL, data, r, true)
 
 	if err != nil {
 		return err
@@ -85,8 +124,8 @@ func (crt *CritsConn) NewSample(fileData []byte, fileName string) (string, error
 	part.Write(fileData)
 
 	payload := make(map[string]string)
-	payload["username"] = crt.Data.Username
-	payload["api_key"] = crt.Data.ApiKey
+	payload["username"] = crt.username
+	payload["api_key"] = crt.apiKey
 	payload["source"] = crt.Data.Source
 	payload["upload_type"] = "file"
 	payload["file_format"] = "raw"
@@ -114,7 +153,9 @@ func (crt *CritsConn) NewSample(fileData []byte, fileName string) (string, error
 	}
 	request.Header.Add("Content-Type", writer.FormDataContentType())
 
-	critsResp, err := crt.C.Client.Do(request)
+	defer crt.limiter.Acquire()()
+	// crits doesn't add the same sample twice
+	critsResp, err := crt.C.Do(request, true)
 	if err != nil {
 		return "", err
 	}
@@ -138,16 +179,68 @@ func (crt *CritsConn) NewSample(fileData []byte, fileName string) (string, error
 	return r.Id, nil
 }
 
-// ForgeRelationship creates a relationship betwenn the object
-// of the current CritsConn context and the supplied id.
-func (crt *CritsConn) ForgeRelationship(id string) error {
-	crt.C.Debug.Printf("Forging relationship with %s and [%s]\n", id, crt.Data.AnalysisId)
+// critsApiPaths maps the crits object types to their api endpoints.
+var critsApiPaths = map[string]string{
+	"Actor":       "actors",
+	"Backdoor":    "backdoors",
+	"Campaign":    "campaigns",
+	"Certificate": "certificates",
+	"Domain":      "domains",
+	"Email":       "emails",
+	"Event":       "events",
+	"Exploit":     "exploits",
+	"Indicator":   "indicators",
+	"IP":          "ips",
+	"PCAP":        "pcaps",
+	"RawData":     "raw_data",
+	"Sample":      "samples",
+	"Screenshot":  "screenshots",
+	"Signature":   "signatures",
+	"Target":      "targets",
+}
 
-	data := url.Values{}
-	data.Add("action", "forge_relationship")
-	data.Add("right_type", "Sample")
-	data.Add("right_id", id)
-	data.Add("rel_type", "Related To")
+// objectURL returns the api url of the given object.
+func (crt *CritsConn) objectURL(objType, objId string) (string, error) {
+	path, known := critsApiPaths[objType]
+	if !known {
+		return "", errors.New("Unknown crits object type: " + objType)
+	}
+
+	return fmt.Sprintf("%s/api/v1/%s/%s/", crt.URL, path, objId), nil
+}
+
+// getObject loads the given object from crits into structPointer.
+func (crt *CritsConn) getObject(objType, objId string, structPointer interface{}) error {
+	objURL, err := crt.objectURL(objType, objId)
+	if err != nil {
+		return err
+	}
+
+	params := url.Values{}
+	params.Add("username", crt.username)
+	params.Add("api_key", crt.apiKey)
+
+	defer crt.limiter.Acquire()()
+	resp, status, err := crt.C.FastGet(objURL+"?"+params.Encode(), structPointer)
+	if err != nil {
+		return err
+	}
+
+	if status != 200 {
+		return errors.New(fmt.Sprintf("%d - %s", status, resp))
+	}
+
+	return nil
+}
+
+// updateObject performs one of the crits object update actions
+// (a PATCH on the object) and returns the parsed response. Set
+// safe if the action can be repeated without harm.
+func (crt *CritsConn) updateObject(objType, objId string, data url.Values, safe bool) (*CrtDefaultResponse, []byte, error) {
+	objURL, err := crt.objectURL(objType, objId)
+	if err != nil {
+		return nil, nil, err
+	}
 
 	// There is currently a "bug" in the way crits parses the auth info
 	// on a PATCH req so we are adding these two as HTTP header.
@@ -156,32 +249,130 @@ func (crt *CritsConn) ForgeRelationship(id string) error {
 
 	request, err := http.NewRequest(
 		"PATCH",
-		fmt.Sprintf("%s/api/v1/samples/%s/", crt.URL, crt.Data.ObjectId),
+		objURL,
 		bytes.NewBufferString(data.Encode()),
 	)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	request.Header.Add("Authorization", fmt.Sprintf("ApiKey %s:%s", crt.Data.Username, crt.Data.ApiKey))
+	request.Header.Add("Authorization", fmt.Sprintf("ApiKey %s:%s", crt.username, crt.apiKey))
 	request.Header.Set("Content-Length", strconv.Itoa(len(data.Encode())))
 	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	critsResp, err := crt.C.Client.Do(request)
+	defer crt.limiter.Acquire()()
+	critsResp, err := crt.C.Do(request, safe)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 	defer SafeResponseClose(critsResp)
 
 	respBody, err := ioutil.ReadAll(critsResp.Body)
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
 
 	r := &CrtDefaultResponse{}
 	err = json.Unmarshal(respBody, r)
 	if err != nil {
-		return errors.New(err.Error() + " : " + string(respBody))
+		return nil, respBody, errors.New(err.Error() + " : " + string(respBody))
+	}
+
+	return r, respBody, nil
+}
+
+// CrtRelationship describes a relationship between two crits
+// objects. It reads as "left RelType right", e.g. a dropped
+// sample (left) "Dropped By" the analysed sample (right).
+type CrtRelationship struct {
+	LeftType   string // empty for the object of the CritsConn context
+	LeftId     string
+	RightType  string
+	RightId    string
+	RelType    string // one of critsRelTypes
+	Confidence string // low, medium, high, or unknown (default)
+	Reason     string
+}
+
+// critsRelTypes contains the relationship types known to crits.
+var critsRelTypes = map[string]bool{
+	"Compressed":       true,
+	"Compressed From":  true,
+	"Connected From":   true,
+	"Connected To":     true,
+	"Contained Within": true,
+	"Contains":         true,
+	"Created":          true,
+	"Created By":       true,
+	"Decoded":          true,
+	"Decoded From":     true,
+	"Decrypted":        true,
+	"Decrypted From":   true,
+	"Downloaded":       true,
+	"Downloaded From":  true,
+	"Dropped":          true,
+	"Dropped By":       true,
+	"Installed":        true,
+	"Installed By":     true,
+	"Loaded From":      true,
+	"Loaded Into":      true,
+	"Packed":           true,
+	"Packed From":      true,
+	"Received":         true,
+	"Received From":    true,
+	"Registered":       true,
+	"Registered To":    true,
+	"Related To":       true,
+	"Resolved To":      true,
+	"Sent":             true,
+	"Sent To":          true,
+	"Sub-domain Of":    true,
+	"Supra-domain Of":  true,
+}
+
+var critsConfidences = map[string]bool{
+	"low":     true,
+	"medium":  true,
+	"high":    true,
+	"unknown": true,
+}
+
+// ForgeRelationship creates the given relationship. Relationships
+// which already exist are not treated as error.
+func (crt *CritsConn) ForgeRelationship(rel *CrtRelationship) error {
+	leftType, leftId := rel.LeftType, rel.LeftId
+	if leftType == "" {
+		leftType, leftId = crt.Data.ObjectType, crt.Data.ObjectId
+	}
+
+	confidence := rel.Confidence
+	if confidence == "" {
+		confidence = "unknown"
+	}
+
+	if !critsRelTypes[rel.RelType] {
+		return errors.New("Unknown relationship type: " + rel.RelType)
+	}
+
+	if !critsConfidences[confidence] {
+		return errors.New("Unknown relationship confidence: " + confidence)
+	}
+
+	crt.C.Debug.Printf("Forging relationship %s %s %s %s %s [%s]\n", leftType, leftId, rel.RelType, rel.RightType, rel.RightId, crt.Data.AnalysisId)
+
+	data := url.Values{}
+	data.Add("action", "forge_relationship")
+	data.Add("right_type", rel.RightType)
+	data.Add("right_id", rel.RightId)
+	data.Add("rel_type", rel.RelType)
+	data.Add("rel_confidence", confidence)
+	if rel.Reason != "" {
+		data.Add("rel_reason", rel.Reason)
+	}
+
+	r, respBody, err := crt.updateObject(leftType, leftId, data, true)
+	if err != nil {
+		return err
 	}
 
 	if (r.ReturnCode != 0 && r.Message != "Relationship already exists") || r.ErrorMsg != "" {
@@ -191,20 +382,185 @@ func (crt *CritsConn) ForgeRelationship(id string) error {
 	return nil
 }
 
+// AddBuckets adds the given buckets to the bucket list of the
+// object of the current CritsConn context. Buckets already set
+// on the object are kept.
+func (crt *CritsConn) AddBuckets(buckets []string) error {
+	crt.C.Debug.Printf("Adding buckets %v to [%s]\n", buckets, crt.Data.AnalysisId)
+
+	// crits replaces the whole bucket list so we have to merge
+	// the new buckets with the existing ones first.
+	obj := &struct {
+		BucketList []string `json:"bucket_list"`
+	}{}
+	if err := crt.getObject(crt.Data.ObjectType, crt.Data.ObjectId, obj); err != nil {
+		return err
+	}
+
+	merged := obj.BucketList
+	for _, b := range buckets {
+		exists := false
+		for _, e := range merged {
+			if e == b {
+				exists = true
+				break
+			}
+		}
+
+		if !exists {
+			merged = append(merged, b)
+		}
+	}
+
+	if len(merged) == len(obj.BucketList) {
+		return nil
+	}
+
+	data := url.Values{}
+	data.Add("action", "bucket_list_update")
+	data.Add("value", strings.Join(merged, ","))
+
+	return crt.simpleUpdate(data, true)
+}
+
+// AddTicket adds a ticket number to the object of the current
+// CritsConn context.
+func (crt *CritsConn) AddTicket(ticket string) error {
+	crt.C.Debug.Printf("Adding ticket %s to [%s]\n", ticket, crt.Data.AnalysisId)
+
+	data := url.Values{}
+	data.Add("action", "ticket_add")
+	data.Add("ticket_number", ticket)
+	data.Add("date", time.Now().Format("2006-01-02 15:04:05.000000"))
+
+	// a retry could add the ticket twice
+	return crt.simpleUpdate(data, false)
+}
+
+// AddCampaign attributes the object of the current CritsConn
+// context to the given campaign.
+func (crt *CritsConn) AddCampaign(campaign, confidence string) error {
+	crt.C.Debug.Printf("Adding campaign %s to [%s]\n", campaign, crt.Data.AnalysisId)
+
+	if confidence == "" {
+		confidence = "unknown"
+	}
+
+	if !critsConfidences[confidence] {
+		return errors.New("Unknown campaign confidence: " + confidence)
+	}
+
+	data := url.Values{}
+	data.Add("action", "campaign_add")
+	data.Add("campaign", campaign)
+	data.Add("confidence", confidence)
+
+	return crt.simpleUpdate(data, true)
+}
+
+// SetStatus sets the status of the object of the current CritsConn
+// context, e.g. "In Progress" or "Analyzed".
+func (crt *CritsConn) SetStatus(status string) error {
+	crt.C.Debug.Printf("Setting status %s on [%s]\n", status, crt.Data.AnalysisId)
+
+	data := url.Values{}
+	data.Add("action", "status_update")
+	data.Add("value", status)
+
+	return crt.simpleUpdate(data, true)
+}
+
+// simpleUpdate performs an update action on the object of the
+// current CritsConn context and checks the response for errors.
+func (crt *CritsConn) simpleUpdate(data url.Values, safe bool) error {
+	r, respBody, err := crt.updateObject(crt.Data.ObjectType, crt.Data.ObjectId, data, safe)
+	if err != nil {
+		return err
+	}
+
+	if r.ReturnCode != 0 || r.ErrorMsg != "" {
+		return errors.New(string(respBody))
+	}
+
+	return nil
+}
+
+// resultChunk is a part of the results which is sent to crits
+// in a single request.
+type resultChunk struct {
+	results  []string
+	types    []string
+	subtypes []string
+}
+
 // AddResults is a "semi wrapper" for crits self._add_result and
-// simple sends a batch of results back to crits.
-func (crt *CritsConn) AddResults(results []*CrtResult) error {
+// sends the results back to crits in chunks of at most ChunkResults
+// results and roughly ChunkBytes bytes. If progressKey is set and
+// the core has a ledger every acknowledged chunk is recorded, so a
+// retry with the same results resumes after the last acknowledged
+// chunk instead of adding the results twice.
+func (crt *CritsConn) AddResults(results []*CrtResult, progressKey string) error {
 	start := time.Now()
 
 	if results == nil || len(results) == 0 {
 		return nil
 	}
 
-	var (
-		arrResult        []string
-		arrResultType    []string
-		arrResultSubtype []string
-	)
+	chunks, digest, err := crt.chunkResults(results)
+	if err != nil {
+		return err
+	}
+
+	done := 0
+	if progressKey != "" {
+		done = crt.ackedChunks(progressKey, digest)
+		if done > 0 {
+			crt.C.Info.Printf("Resuming after %d of %d acknowledged chunks [%s]\n", done, len(chunks), crt.Data.AnalysisId)
+		}
+	}
+
+	for i := done; i < len(chunks); i++ {
+		if err = crt.addResultChunk(chunks[i]); err != nil {
+			return errors.New(fmt.Sprintf("chunk %d of %d: %s", i+1, len(chunks), err))
+		}
+
+		if progressKey != "" {
+			if err = crt.C.Ledger.Set(progressKey, fmt.Sprintf("%s %d", digest, i+1)); err != nil {
+				crt.C.Warning.Println("Couldn't record chunk in ledger!", err)
+			}
+		}
+	}
+
+	elapsed := time.Since(start)
+	crt.C.Debug.Printf("Added %d results in %d chunks in %s to [%s]\n", len(results), len(chunks)-done, elapsed, crt.Data.AnalysisId)
+
+	return nil
+}
+
+// ackedChunks returns the number of chunks crits already acknowledged
+// for the given key. Progress recorded for different results (e.g.
+// because the report changed) is ignored.
+func (crt *CritsConn) ackedChunks(progressKey, digest string) int {
+	progress, found := crt.C.Ledger.Get(progressKey)
+	if !found {
+		return 0
+	}
+
+	ackedDigest, acked := "", 0
+	if _, err := fmt.Sscanf(progress, "%s %d", &ackedDigest, &acked); err != nil || ackedDigest != digest {
+		return 0
+	}
+
+	return acked
+}
+
+// chunkResults converts the results into the format crits expects and
+// splits them into chunks. It also returns a digest of all results.
+func (crt *CritsConn) chunkResults(results []*CrtResult) ([]*resultChunk, string, error) {
+	chunks := []*resultChunk{}
+	chunk := &resultChunk{}
+	chunkBytes := 0
+	hash := sha1.New()
 
 	for _, r := range results {
 		result_type := "{}"
@@ -220,28 +576,52 @@ func (crt *CritsConn) AddResults(results []*CrtResult) error {
 
 			rtJson, err := json.Marshal(r.Data)
 			if err != nil {
-				return err
+				return nil, "", err
 			}
 
 			result_type = string(rtJson)
 		}
 
-		arrResult = append(arrResult, r.Result)
-		arrResultType = append(arrResultType, result_type)
-		arrResultSubtype = append(arrResultSubtype, r.Subtype)
+		// the values end up json encoded in a form so this is only
+		// an estimate, but a close one.
+		size := len(url.QueryEscape(r.Result)) + len(url.QueryEscape(result_type)) + len(url.QueryEscape(r.Subtype))
+
+		if len(chunk.results) > 0 && (len(chunk.results) >= crt.ChunkResults || chunkBytes+size > crt.ChunkBytes) {
+			chunks = append(chunks, chunk)
+			chunk = &resultChunk{}
+			chunkBytes = 0
+		}
+
+		if size > crt.ChunkBytes {
+			crt.C.Warning.Printf("Result %s (%s) is bigger than ChunkBytes (%d bytes) [%s]\n", r.Subtype, r.Result, size, crt.Data.AnalysisId)
+		}
+
+		chunk.results = append(chunk.results, r.Result)
+		chunk.types = append(chunk.types, result_type)
+		chunk.subtypes = append(chunk.subtypes, r.Subtype)
+		chunkBytes += size
+
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00", r.Subtype, r.Result, result_type)
 	}
 
-	arrResultJ, err := json.Marshal(arrResult)
+	chunks = append(chunks, chunk)
+
+	return chunks, fmt.Sprintf("%x", hash.Sum(nil)), nil
+}
+
+// addResultChunk sends a single chunk of results to crits.
+func (crt *CritsConn) addResultChunk(chunk *resultChunk) error {
+	arrResultJ, err := json.Marshal(chunk.results)
 	if err != nil {
 		return err
 	}
 
-	arrResultTypeJ, err := json.Marshal(arrResultType)
+	arrResultTypeJ, err := json.Marshal(chunk.types)
 	if err != nil {
 		return err
 	}
 
-	arrResultSubtypeJ, err := json.Marshal(arrResultSubtype)
+	arrResultSubtypeJ, err := json.Marshal(chunk.subtypes)
 	if err != nil {
 		return err
 	}
@@ -254,11 +634,13 @@ func (crt *CritsConn) AddResults(results []*CrtResult) error {
 	data.Add("analysis_id", crt.Data.AnalysisId)
 	data.Add("object_type", crt.Data.ObjectType)
 	data.Add("object_id", crt.Data.ObjectId)
-	data.Add("username", crt.Data.Username)
-	data.Add("api_key", crt.Data.ApiKey)
+	data.Add("username", crt.username)
+	data.Add("api_key", crt.apiKey)
 
 	r := &CrtDefaultResponse{}
-	resp, status, err := crt.C.FastPostForm(crt.URL+"/api/v1/services/", data, r)
+	defer crt.limiter.Acquire()()
+	// a retry could add the chunk twice
+	resp, status, err := crt.C.FastPostForm(crt.URL+"/api/v1/services/", data, r, false)
 
 	if err != nil {
 		return err
@@ -268,9 +650,6 @@ func (crt *CritsConn) AddResults(results []*CrtResult) error {
 		return errors.New(fmt.Sprintf("%d - %s", status, resp))
 	}
 
-	elapsed := time.Since(start)
-	crt.C.Debug.Printf("Added %d results in %s to [%s]\n", len(results), elapsed, crt.Data.AnalysisId)
-
 	return nil
 }
 
@@ -284,11 +663,12 @@ func (crt *CritsConn) MarkAsRunning() error {
 	data.Add("analysis_id", crt.Data.AnalysisId)
 	data.Add("object_type", crt.Data.ObjectType)
 	data.Add("object_id", crt.Data.ObjectId)
-	data.Add("username", crt.Data.Username)
-	data.Add("api_key", crt.Data.ApiKey)
+	data.Add("username", crt.username)
+	data.Add("api_key", crt.apiKey)
 
 	r := &CrtDefaultResponse{}
-	resp, status, err := crt.C.FastPostForm(crt.URL+"/api/v1/services/", data, r)
+	defer crt.limiter.Acquire()()
+	resp, status, err := crt.C.FastPostForm(crt.URL+"/api/v1/services/", data, r, true)
 
 	if err != nil {
 		return err
@@ -308,11 +688,12 @@ func (crt *CritsConn) MarkAsFinished() error {
 	data.Add("analysis_id", crt.Data.AnalysisId)
 	data.Add("object_type", crt.Data.ObjectType)
 	data.Add("object_id", crt.Data.ObjectId)
-	data.Add("username", crt.Data.Username)
-	data.Add("api_key", crt.Data.ApiKey)
+	data.Add("username", crt.username)
+	data.Add("api_key", crt.apiKey)
 
 	r := &CrtDefaultResponse{}
-	resp, status, err := crt.C.FastPostForm(crt.URL+"/api/v1/services/", data, r)
+	defer crt.limiter.Acquire()()
+	resp, status, err := crt.C.FastPostForm(crt.URL+"/api/v1/services/", data, r, true)
 
 	if err != nil {
 		return err
@@ -0,0 +1,84 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// CrtObjectOpts holds the information crits needs about the
+// origin of a new top level object.
+type CrtObjectOpts struct {
+	Source     string
+	Method     string
+	Reference  string
+	Confidence string // low, medium, high, or unknown
+	Impact     string // low, medium, high, or unknown (indicators only)
+}
+
+// NewIndicator creates a new indicator or adds the source to an
+// existing one. It returns the id of the indicator.
+func (crt *CritsConn) NewIndicator(indType, value string, opts *CrtObjectOpts) (string, error) {
+	data := url.Values{}
+	data.Add("type", indType)
+	data.Add("value", value)
+	data.Add("indicator_confidence", opts.Confidence)
+	data.Add("indicator_impact", opts.Impact)
+
+	return crt.createObject("Indicator", data, opts)
+}
+
+// NewDomain creates a new domain or adds the source to an existing
+// one. It returns the id of the domain.
+func (crt *CritsConn) NewDomain(domain string, opts *CrtObjectOpts) (string, error) {
+	data := url.Values{}
+	data.Add("domain", domain)
+
+	return crt.createObject("Domain", data, opts)
+}
+
+// NewIP creates a new ip or adds the source to an existing one.
+// ipType is the crits ip type like "IPv4 Address". It returns the
+// id of the ip.
+func (crt *CritsConn) NewIP(ip, ipType string, opts *CrtObjectOpts) (string, error) {
+	data := url.Values{}
+	data.Add("ip", ip)
+	data.Add("ip_type", ipType)
+
+	return crt.createObject("IP", data, opts)
+}
+
+// createObject posts a new object of the given type to crits. Since
+// crits merges new objects into existing ones this can be used to
+// create or update an object.
+func (crt *CritsConn) createObject(objType string, data url.Values, opts *CrtObjectOpts) (string, error) {
+	path, known := critsApiPaths[objType]
+	if !known {
+		return "", errors.New("Unknown crits object type: " + objType)
+	}
+
+	source := opts.Source
+	if source == "" {
+		source = crt.Data.Source
+	}
+
+	data.Add("source", source)
+	data.Add("method", opts.Method)
+	data.Add("reference", opts.Reference)
+	data.Add("username", crt.username)
+	data.Add("api_key", crt.apiKey)
+
+	r := &CrtDefaultResponse{}
+	defer crt.limiter.Acquire()()
+	// crits merges objects with the same value, so retries are fine
+	resp, status, err := crt.C.FastPostForm(fmt.Sprintf("%s/api/v1/%s/", crt.URL, path), data, r, true)
+	if err != nil {
+		return "", err
+	}
+
+	if status != 200 && status != 201 || r.ReturnCode != 0 || r.ErrorMsg != "" {
+		return "", errors.New(fmt.Sprintf("%d - %s", status, resp))
+	}
+
+	return r.Id, nil
+}
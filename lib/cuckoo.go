@@ -5,9 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
 	"time"
 )
 
@@ -45,13 +49,89 @@ type CkoTasksViewResp struct {
 }
 
 type CkoTasksViewTask struct {
-	Status string `json:"status"`
+	Status string                  `json:"status"`
+	Target string                  `json:"target"`
+	Sample *CkoTasksViewTaskSample `json:"sample"`
+}
+
+type CkoTasksViewTaskSample struct {
+	SHA256 string `json:"sha256"`
 }
 
 type CkoTasksReport struct {
 	Info       *CkoTasksReportInfo        `json:"info"`
-	Signatures []*CkoTasksReportSignature `json;"signatures"`
+	Target     *CkoTasksReportTarget      `json:"target"`
+	Signatures []*CkoTasksReportSignature `json:"signatures"`
 	Behavior   *CkoTasksReportBehavior    `json:"behavior"`
+	Network    *CkoTasksReportNetwork     `json:"network"`
+	Dropped    []*CkoTasksReportFile      `json:"dropped"`
+}
+
+type CkoTasksReportTarget struct {
+	Category string              `json:"category"`
+	File     *CkoTasksReportFile `json:"file"`
+}
+
+// CkoTasksReportFile is used for the target file as well as
+// for dropped files.
+type CkoTasksReportFile struct {
+	Name   string                `json:"name"`
+	Size   int                   `json:"size"`
+	Type   string                `json:"type"`
+	MD5    string                `json:"md5"`
+	SHA1   string                `json:"sha1"`
+	SHA256 string                `json:"sha256"`
+	Yara   []*CkoTasksReportYara `json:"yara"`
+}
+
+type CkoTasksReportYara struct {
+	Name string            `json:"name"`
+	Meta map[string]string `json:"meta"`
+}
+
+type CkoTasksReportNetwork struct {
+	Hosts   []CkoTasksReportHost        `json:"hosts"`
+	Domains []*CkoTasksReportNetDomain  `json:"domains"`
+	Http    []*CkoTasksReportNetHttpReq `json:"http"`
+}
+
+// CkoTasksReportHost is the ip of a contacted host. Depending
+// on the cuckoo version hosts are strings or objects.
+type CkoTasksReportHost string
+
+func (h *CkoTasksReportHost) UnmarshalJSON(b []byte) error {
+	ip := ""
+	if err := json.Unmarshal(b, &ip); err == nil {
+		*h = CkoTasksReportHost(ip)
+		return nil
+	}
+
+	obj := struct {
+		Ip string `json:"ip"`
+	}{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return err
+	}
+
+	*h = CkoTasksReportHost(obj.Ip)
+	return nil
+}
+
+type CkoTasksReportNetDomain struct {
+	Domain string `json:"domain"`
+	Ip     string `json:"ip"`
+}
+
+type CkoTasksReportNetHttpReq struct {
+	Uri    string `json:"uri"`
+	Host   string `json:"host"`
+	Method string `json:"method"`
+}
+
+// IsExecutable checks the file type reported by cuckoo for
+// windows and linux executables.
+func (f *CkoTasksReportFile) IsExecutable() bool {
+	return strings.Contains(f.Type, "PE32") || strings.Contains(f.Type, "executable")
 }
 
 type CkoTasksReportInfo struct {
@@ -66,9 +146,70 @@ type CkoTasksReportInfoMachine struct {
 }
 
 type CkoTasksReportSignature struct {
-	Severity    int    `json:"severity"`
-	Description string `json:"description"`
-	Name        string `json:"name"`
+	Severity    int               `json:"severity"`
+	Description string            `json:"description"`
+	Name        string            `json:"name"`
+	Families    []string          `json:"families"`
+	References  []string          `json:"references"`
+	Marks       []json.RawMessage `json:"marks"` // cuckoo >= 2.0
+	Data        []json.RawMessage `json:"data"`  // cuckoo < 2.0
+	TTP         json.RawMessage   `json:"ttp"`   // list OR map of technique ids
+}
+
+// Evidence returns the marks (or data for older cuckoo versions)
+// of the signature.
+func (s *CkoTasksReportSignature) Evidence() []json.RawMessage {
+	if len(s.Marks) > 0 {
+		return s.Marks
+	}
+
+	return s.Data
+}
+
+// TTPIds returns the ATT&CK technique ids of the signature. Depending
+// on the cuckoo version ttp is a list of ids, a list of objects, or
+// a map keyed by the ids.
+func (s *CkoTasksReportSignature) TTPIds() []string {
+	if len(s.TTP) == 0 {
+		return nil
+	}
+
+	ids := []string{}
+
+	list := []json.RawMessage{}
+	if err := json.Unmarshal(s.TTP, &list); err == nil {
+		for _, e := range list {
+			id := ""
+			if err := json.Unmarshal(e, &id); err == nil && id != "" {
+				ids = append(ids, id)
+				continue
+			}
+
+			obj := struct {
+				Id  string `json:"id"`
+				TTP string `json:"ttp"`
+			}{}
+			if err := json.Unmarshal(e, &obj); err == nil {
+				if obj.Id != "" {
+					ids = append(ids, obj.Id)
+				} else if obj.TTP != "" {
+					ids = append(ids, obj.TTP)
+				}
+			}
+		}
+
+		return ids
+	}
+
+	m := make(map[string]json.RawMessage)
+	if err := json.Unmarshal(s.TTP, &m); err == nil {
+		for id := range m {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+	}
+
+	return ids
 }
 
 type CkoTasksReportBehavior struct {
@@ -107,11 +248,17 @@ type CkoTasksReportBhvSummary struct {
 	Mutexes []string `json:"mutexes"`
 }
 
-func (c *Core) NewCuckoo(URL string) *CuckooConn {
+// NewCuckoo returns a connection to the cuckoo instance at URL. It
+// fails if the instance isn't allowed.
+func (c *Core) NewCuckoo(URL string) (*CuckooConn, error) {
+	if err := c.cuckooAllowed.check(URL); err != nil {
+		return nil, err
+	}
+
 	return &CuckooConn{
 		C:   c,
 		URL: URL,
-	}
+	}, nil
 }
 
 func (cko *CuckooConn) GetPending() (int, error) {
@@ -175,8 +322,8 @@ func (cko *CuckooConn) NewTask(fileBytes []byte, fileName string, params map[str
 	}
 	request.Header.Add("Content-Type", writer.FormDataContentType())
 
-	// perform request
-	resp, err := cko.C.Client.Do(request)
+	// perform request, a retry could create the task twice
+	resp, err := cko.C.Do(request, false)
 	if err != nil {
 		return 0, err
 	}
@@ -217,15 +364,52 @@ func (cko *CuckooConn) TaskStatus(id int) (string, error) {
 	return r.Task.Status, nil
 }
 
-func (cko *CuckooConn) TaskReport(id int) (*CkoTasksReport, error) {
+// TaskFailed checks if cuckoo gave up on a task with the given
+// status, e.g. "failed_analysis".
+func TaskFailed(status string) bool {
+	return strings.HasPrefix(status, "failed_")
+}
+
+// TaskSample downloads the sample of a task and returns its file
+// name and content.
+func (cko *CuckooConn) TaskSample(id int) (string, []byte, error) {
+	r := &CkoTasksViewResp{}
+	resp, status, err := cko.C.FastGet(fmt.Sprintf("%s/tasks/view/%d", cko.URL, id), r)
+	if err == nil && status != 200 {
+		err = errors.New(fmt.Sprintf("[%d] %s", status, resp))
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	if r.Task == nil || r.Task.Sample == nil || r.Task.Sample.SHA256 == "" {
+		return "", nil, errors.New(fmt.Sprintf("task %d has no sample", id))
+	}
+
+	data, status, err := cko.C.FastGet(fmt.Sprintf("%s/files/get/%s", cko.URL, r.Task.Sample.SHA256), nil)
+	if err == nil && status != 200 {
+		err = errors.New(fmt.Sprintf("[%d] %s", status, data))
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return filepath.Base(r.Task.Target), data, nil
+}
+
+// TaskReport streams the report of the given task from cuckoo and
+// decodes only the parts selected by opts. A nil opts decodes the
+// whole report.
+func (cko *CuckooConn) TaskReport(id int, opts *CkoReportOpts) (*CkoTasksReport, error) {
 	start := time.Now()
-	r := &CkoTasksReport{}
-	resp, status, err := cko.C.FastGet(fmt.Sprintf("%s/tasks/report/%d", cko.URL, id), r)
-	if err != nil || status != 200 {
-		if resp != nil {
-			err = errors.New(fmt.Sprintf("%s -> [%d] %s", err.Error(), status, resp))
-		}
 
+	var r *CkoTasksReport
+	_, err := cko.C.StreamGet(fmt.Sprintf("%s/tasks/report/%d", cko.URL, id), func(body io.Reader) error {
+		var err error
+		r, err = decodeReport(body, opts)
+		return err
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,124 @@
+package lib
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// The signatures used to be lost because of a broken json tag.
+func TestReportSignaturesTag(t *testing.T) {
+	r := &CkoTasksReport{}
+	err := json.Unmarshal([]byte(`{"signatures": [{"name": "mutex", "severity": 2, "description": "Creates a mutex"}]}`), r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(r.Signatures) != 1 || r.Signatures[0].Name != "mutex" || r.Signatures[0].Severity != 2 {
+		t.Errorf("signatures = %+v", r.Signatures)
+	}
+}
+
+func TestSignatureDetails(t *testing.T) {
+	s := &CkoTasksReportSignature{}
+	err := json.Unmarshal([]byte(`{
+		"name": "banker_zeus_mutex",
+		"families": ["zeus", "citadel"],
+		"references": ["https://example.com/zeus"],
+		"marks": [{"type": "generic", "mutex": "x"}]
+	}`), s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(s.Families, []string{"zeus", "citadel"}) {
+		t.Errorf("families = %v", s.Families)
+	}
+	if !reflect.DeepEqual(s.References, []string{"https://example.com/zeus"}) {
+		t.Errorf("references = %v", s.References)
+	}
+}
+
+func TestSignatureEvidence(t *testing.T) {
+	tests := []struct {
+		sig  string
+		want []string
+	}{
+		{`{"marks": [{"mutex": "x"}, {"file": "y"}]}`, []string{`{"mutex": "x"}`, `{"file": "y"}`}},
+		{`{"data": [{"file": "y"}]}`, []string{`{"file": "y"}`}},
+
+		// marks win over data unless there are none
+		{`{"marks": [{"mutex": "x"}], "data": [{"file": "y"}]}`, []string{`{"mutex": "x"}`}},
+		{`{"marks": [], "data": [{"file": "y"}]}`, []string{`{"file": "y"}`}},
+		{`{}`, []string{}},
+	}
+
+	for _, tt := range tests {
+		s := &CkoTasksReportSignature{}
+		if err := json.Unmarshal([]byte(tt.sig), s); err != nil {
+			t.Fatal(err)
+		}
+
+		got := []string{}
+		for _, e := range s.Evidence() {
+			got = append(got, string(e))
+		}
+
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Evidence() of %s = %v, want %v", tt.sig, got, tt.want)
+		}
+	}
+}
+
+func TestSignatureTTPIds(t *testing.T) {
+	tests := []struct {
+		ttp  string
+		want []string
+	}{
+		{`["T1055", "T1112"]`, []string{"T1055", "T1112"}},
+		{`[{"id": "T1055"}, {"ttp": "T1112"}, {"name": "no id"}]`, []string{"T1055", "T1112"}},
+		{`["T1055", {"id": "T1112"}, "", 5]`, []string{"T1055", "T1112"}},
+		{`{"T1112": {"short": "Modify Registry"}, "T1055": {}}`, []string{"T1055", "T1112"}},
+		{`[]`, []string{}},
+		{`null`, []string{}},
+		{`"T1055"`, []string{}},
+	}
+
+	for _, tt := range tests {
+		s := &CkoTasksReportSignature{TTP: json.RawMessage(tt.ttp)}
+		if got := s.TTPIds(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("TTPIds() of %s = %v, want %v", tt.ttp, got, tt.want)
+		}
+	}
+
+	if ids := (&CkoTasksReportSignature{}).TTPIds(); ids != nil {
+		t.Errorf("TTPIds() without ttp = %v", ids)
+	}
+}
+
+func TestReportHosts(t *testing.T) {
+	tests := []struct {
+		hosts string
+		want  []CkoTasksReportHost
+	}{
+		{`["10.0.0.1", "8.8.8.8"]`, []CkoTasksReportHost{"10.0.0.1", "8.8.8.8"}},
+		{`[{"ip": "10.0.0.1", "country_name": "reserved"}]`, []CkoTasksReportHost{"10.0.0.1"}},
+		{`["10.0.0.1", {"ip": "8.8.8.8"}]`, []CkoTasksReportHost{"10.0.0.1", "8.8.8.8"}},
+	}
+
+	for _, tt := range tests {
+		n := &CkoTasksReportNetwork{}
+		if err := json.Unmarshal([]byte(`{"hosts": `+tt.hosts+`}`), n); err != nil {
+			t.Fatalf("hosts %s: %s", tt.hosts, err)
+		}
+
+		if !reflect.DeepEqual(n.Hosts, tt.want) {
+			t.Errorf("hosts %s = %v, want %v", tt.hosts, n.Hosts, tt.want)
+		}
+	}
+
+	n := &CkoTasksReportNetwork{}
+	if err := json.Unmarshal([]byte(`{"hosts": [1]}`), n); err == nil {
+		t.Errorf("host 1 = %v, want an error", n.Hosts)
+	}
+}
@@ -0,0 +1,292 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Types of the messages sent between the services.
+const (
+	MsgTypeDistributedCuckoo = "distributed_cuckoo_req" // crits -> feed_cuckoo
+	MsgTypeFeedCuckoo        = "feed_cuckoo_req"        // feed_cuckoo -> check_results
+	MsgTypeCheckResults      = "check_results_req"      // check_results -> parse_and_submit
+	MsgTypeFailed            = "failed_msg"             // any service -> overseer
+)
+
+// SchemaVersion is the version of the message formats written by
+// this version of the services. Messages without an envelope are
+// version 1.
+//
+//	2: envelope, snake case fields
+//	3: failure classification in failed_msg
+const SchemaVersion = 3
+
+// ConsumedTypes maps each service to the type of the messages it
+// consumes, e.g. to decode a message the service failed on.
+var ConsumedTypes = map[string]string{
+	"feed_cuckoo":      MsgTypeDistributedCuckoo,
+	"check_results":    MsgTypeFeedCuckoo,
+	"parse_and_submit": MsgTypeCheckResults,
+	"overseer":         MsgTypeFailed,
+}
+
+// Envelope wraps every message sent between the services.
+type Envelope struct {
+	Type          string          `json:"type"`
+	SchemaVersion int             `json:"schema_version"`
+	MessageId     string          `json:"message_id"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Trace         string          `json:"trace,omitempty"` // W3C traceparent of the sender
+	Attempt       int             `json:"attempt"`         // number of times the message was resubmitted
+	Payload       json.RawMessage `json:"payload"`
+}
+
+// upgrader converts the payload of a message to the next version.
+type upgrader func(payload json.RawMessage) (json.RawMessage, error)
+
+// upgraders contains the upgrade shims of each message type, keyed
+// by the version they upgrade from.
+var upgraders = map[string]map[int]upgrader{
+	MsgTypeDistributedCuckoo: {
+		// the bare message of version 1 already used snake case
+		1: unchanged,
+		2: unchanged,
+	},
+	MsgTypeFeedCuckoo: {
+		1: func(p json.RawMessage) (json.RawMessage, error) {
+			v1 := &struct {
+				TaskId    int
+				CuckooURL string
+				CritsData *CritsData
+				Payload   map[string]string
+			}{}
+			if err := json.Unmarshal(p, v1); err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(&FeedCuckooReq{v1.TaskId, v1.CuckooURL, v1.CritsData, v1.Payload})
+		},
+		2: unchanged,
+	},
+	MsgTypeCheckResults: {
+		1: func(p json.RawMessage) (json.RawMessage, error) {
+			v1 := &struct {
+				CuckooURL string
+				TaskId    int
+				CritsData *CritsData
+				Payload   map[string]string
+			}{}
+			if err := json.Unmarshal(p, v1); err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(&CheckResultsReq{v1.CuckooURL, v1.TaskId, v1.CritsData, v1.Payload})
+		},
+		2: unchanged,
+	},
+	MsgTypeFailed: {
+		1: func(p json.RawMessage) (json.RawMessage, error) {
+			v1 := &struct {
+				Service string
+				Queue   string
+				Error   string
+				Desc    string
+				Msg     string
+			}{}
+			if err := json.Unmarshal(p, v1); err != nil {
+				return nil, err
+			}
+
+			return json.Marshal(&FailedMsg{
+				Service: v1.Service,
+				Queue:   v1.Queue,
+				Error:   v1.Error,
+				Desc:    v1.Desc,
+				Msg:     v1.Msg,
+			})
+		},
+		2: func(p json.RawMessage) (json.RawMessage, error) {
+			// failures weren't classified, retry them like before
+			m := &FailedMsg{}
+			if err := json.Unmarshal(p, m); err != nil {
+				return nil, err
+			}
+
+			m.Code = ErrInternal
+			m.Retryable = true
+			return json.Marshal(m)
+		},
+	},
+}
+
+// unchanged is the upgrade of payloads which didn't change.
+func unchanged(p json.RawMessage) (json.RawMessage, error) {
+	return p, nil
+}
+
+// NewEnvelope wraps payload in an envelope of the given type. The
+// trace of c is recorded in the envelope.
+func (c *Core) NewEnvelope(msgType string, payload interface{}) ([]byte, error) {
+	return c.newEnvelope(msgType, payload, 0)
+}
+
+// NextEnvelope wraps payload like NewEnvelope for the stage after
+// msg. The attempt of msg is carried on, so the overseer knows how
+// often the message was retried at any of the stages.
+func (c *Core) NextEnvelope(msg *amqp.Delivery, msgType string, payload interface{}) ([]byte, error) {
+	return c.newEnvelope(msgType, payload, AttemptOf(msg))
+}
+
+func (c *Core) newEnvelope(msgType string, payload interface{}, attempt int) ([]byte, error) {
+	p, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	env := &Envelope{
+		Type:          msgType,
+		SchemaVersion: SchemaVersion,
+		MessageId:     randomHex(16),
+		CreatedAt:     time.Now().UTC(),
+		Attempt:       attempt,
+		Payload:       p,
+	}
+	if c.span != nil {
+		env.Trace = c.span.Traceparent()
+	}
+
+	return json.Marshal(env)
+}
+
+// OpenEnvelope decodes a message of the given type, upgrades it to
+// the current schema version if needed, and decodes the payload into
+// payload. Messages without an envelope are treated as version 1.
+func OpenEnvelope(body []byte, msgType string, payload interface{}) (*Envelope, error) {
+	env, err := decodeEnvelope(body, msgType)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.Type != msgType {
+		return env, errors.New(fmt.Sprintf("expected a %s message but got %s", msgType, env.Type))
+	}
+
+	if env.SchemaVersion > SchemaVersion {
+		return env, errors.New(fmt.Sprintf("schema version %d of %s is newer than the supported version %d", env.SchemaVersion, env.Type, SchemaVersion))
+	}
+
+	for env.SchemaVersion < SchemaVersion {
+		up, exists := upgraders[env.Type][env.SchemaVersion]
+		if !exists {
+			return env, errors.New(fmt.Sprintf("can't upgrade %s from schema version %d", env.Type, env.SchemaVersion))
+		}
+
+		if env.Payload, err = up(env.Payload); err != nil {
+			return env, errors.New(fmt.Sprintf("upgrading %s from schema version %d failed: %s", env.Type, env.SchemaVersion, err))
+		}
+		env.SchemaVersion += 1
+	}
+
+	if payload != nil {
+		err = json.Unmarshal(env.Payload, payload)
+	}
+
+	return env, err
+}
+
+// decodeEnvelope decodes the envelope of body. A message without an
+// envelope is wrapped into one of version 1 and the given type.
+func decodeEnvelope(body []byte, msgType string) (*Envelope, error) {
+	env := &Envelope{}
+	if err := json.Unmarshal(body, env); err != nil {
+		return nil, err
+	}
+
+	if env.Type == "" && env.SchemaVersion == 0 {
+		return &Envelope{
+			Type:          msgType,
+			SchemaVersion: 1,
+			Payload:       json.RawMessage(body),
+		}, nil
+	}
+
+	return env, nil
+}
+
+// Resubmission returns body with the attempt counter of its envelope
+// increased by one. Messages of older versions are upgraded on the
+// way so the consumer can rely on the current format.
+func Resubmission(body []byte, msgType string) ([]byte, *Envelope, error) {
+	env, err := OpenEnvelope(body, msgType, nil)
+	if err != nil {
+		return nil, env, err
+	}
+
+	if env.MessageId == "" {
+		env.MessageId = randomHex(16)
+		env.CreatedAt = time.Now().UTC()
+	}
+	env.Attempt += 1
+
+	resubmitted, err := json.Marshal(env)
+	return resubmitted, env, err
+}
+
+// Replay returns body with the attempt counter of its envelope
+// reset, e.g. to replay a message which was dead-lettered.
+func Replay(body []byte, msgType string) ([]byte, error) {
+	env, err := OpenEnvelope(body, msgType, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.MessageId == "" {
+		env.MessageId = randomHex(16)
+		env.CreatedAt = time.Now().UTC()
+	}
+	env.Attempt = 0
+
+	return json.Marshal(env)
+}
+
+// AttemptOf returns how often msg was resubmitted so far, according
+// to its AttemptHeader or the attempt of its envelope.
+func AttemptOf(msg *amqp.Delivery) int {
+	attempt := 0
+	switch a := msg.Headers[AttemptHeader].(type) {
+	case int32:
+		attempt = int(a)
+	case int64:
+		attempt = int(a)
+	case int:
+		attempt = a
+	}
+
+	env := &Envelope{}
+	if err := json.Unmarshal(msg.Body, env); err == nil && env.Attempt > attempt {
+		attempt = env.Attempt
+	}
+
+	return attempt
+}
+
+// CritsDataOf returns the crits data of any message of the given type.
+func CritsDataOf(body []byte, msgType string) (*CritsData, error) {
+	p := &struct {
+		CritsData *CritsData `json:"crits_data"`
+	}{}
+
+	if _, err := OpenEnvelope(body, msgType, p); err != nil {
+		return nil, err
+	}
+
+	if p.CritsData == nil {
+		return nil, errors.New("message contains no crits data")
+	}
+
+	return p.CritsData, nil
+}
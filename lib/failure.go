@@ -0,0 +1,39 @@
+package lib
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// Codes classifying why a message failed, see FailedMsg.
+const (
+	ErrMalformed  = "malformed"          // the msg can't be decoded or is invalid
+	ErrNotAllowed = "not_allowed"        // the msg references an instance or user which isn't allowed
+	ErrCuckoo     = "cuckoo_unavailable" // cuckoo couldn't be reached or answered with an error
+	ErrCrits      = "crits_unavailable"  // crits couldn't be reached or answered with an error
+	ErrTaskFailed = "task_failed"        // cuckoo failed to analyse the sample
+	ErrInternal   = "internal"           // anything else
+)
+
+// retryableCodes contains the codes of failures which may go away
+// by themselves.
+var retryableCodes = map[string]bool{
+	ErrMalformed:  false,
+	ErrNotAllowed: false,
+	ErrCuckoo:     true,
+	ErrCrits:      true,
+	ErrTaskFailed: true,
+	ErrInternal:   true,
+}
+
+// NackWithCode works like NackOnError but classifies the failure
+// with code, so the overseer knows if the msg should be retried.
+func (c *Core) NackWithCode(err error, code, desc string, msg *amqp.Delivery) bool {
+	return c.nack(err, &FailedMsg{Code: code, Retryable: retryableCodes[code]}, desc, msg)
+}
+
+// NackRestart works like NackWithCode but asks the overseer to
+// restart the handling at the given service with restart, a
+// message of the type consumed by that service.
+func (c *Core) NackRestart(err error, code, stage string, restart []byte, desc string, msg *amqp.Delivery) bool {
+	return c.nack(err, &FailedMsg{Code: code, Retryable: retryableCodes[code], Stage: stage, Restart: string(restart)}, desc, msg)
+}
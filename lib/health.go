@@ -0,0 +1,217 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// ReadyCheck checks a dependency of the service. It returns details
+// shown in /readyz and an error if the dependency isn't usable.
+type ReadyCheck func() (interface{}, error)
+
+// reachableTimeout is the time a dependency has to answer a
+// readiness check.
+const reachableTimeout = time.Second * 5
+
+type health struct {
+	started  time.Time
+	checks   map[string]ReadyCheck
+	channels []*channelState
+	mutex    *sync.Mutex
+}
+
+// channelState tracks if an amqp channel was closed by the broker.
+type channelState struct {
+	Queue  string `json:"queue"`
+	Closed bool   `json:"closed"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type checkResult struct {
+	Status string      `json:"status"`
+	Error  string      `json:"error,omitempty"`
+	Detail interface{} `json:"detail,omitempty"`
+}
+
+func (c *Core) setupHealth() {
+	c.health = &health{
+		started: time.Now(),
+		checks:  make(map[string]ReadyCheck),
+		mutex:   &sync.Mutex{},
+	}
+
+	c.AddReadyCheck("amqp", c.checkAmqp)
+	c.AddReadyCheck("http", c.checkBreakers)
+}
+
+// AddReadyCheck adds a check which has to pass for the service
+// to be ready.
+func (c *Core) AddReadyCheck(name string, check ReadyCheck) {
+	c.health.mutex.Lock()
+	defer c.health.mutex.Unlock()
+
+	c.health.checks[name] = check
+}
+
+// watchChannel records when the broker closes the channel of a
+// queue handler.
+func (c *Core) watchChannel(queue string, channel *amqp.Channel) {
+	state := &channelState{Queue: queue}
+
+	c.health.mutex.Lock()
+	c.health.channels = append(c.health.channels, state)
+	c.health.mutex.Unlock()
+
+	notify := channel.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		reason := "closed"
+		if err, ok := <-notify; ok && err != nil {
+			reason = err.Error()
+		}
+
+		c.Warning.Printf("Channel of queue %s closed: %s\n", queue, reason)
+
+		c.health.mutex.Lock()
+		state.Closed = true
+		state.Reason = reason
+		c.health.mutex.Unlock()
+	}()
+}
+
+// checkAmqp fails if the connection or one of the channels to the
+// amqp broker is closed.
+func (c *Core) checkAmqp() (interface{}, error) {
+	c.health.mutex.Lock()
+	channels := []channelState{}
+	closed := 0
+	for _, s := range c.health.channels {
+		channels = append(channels, *s)
+		if s.Closed {
+			closed += 1
+		}
+	}
+	c.health.mutex.Unlock()
+
+	if c.AmqpConn == nil || c.AmqpConn.IsClosed() {
+		return channels, errors.New("connection closed")
+	}
+
+	if closed > 0 {
+		return channels, errors.New(fmt.Sprintf("%d of %d channels closed", closed, len(channels)))
+	}
+
+	return channels, nil
+}
+
+// checkBreakers fails if the circuit breaker of a host is open.
+func (c *Core) checkBreakers() (interface{}, error) {
+	states := c.BreakerStates()
+
+	open := []string{}
+	for host, state := range states {
+		if state == BreakerOpen {
+			open = append(open, host)
+		}
+	}
+	sort.Strings(open)
+
+	if len(open) > 0 {
+		return states, errors.New(fmt.Sprintf("circuit breaker open for %v", open))
+	}
+
+	return states, nil
+}
+
+// Reachable checks if the server at url answers at all. Other than
+// requests sent with Do this isn't retried and doesn't count for
+// the circuit breakers.
+func (c *Core) Reachable(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), reachableTimeout)
+	defer cancel()
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer SafeResponseClose(resp)
+
+	if resp.StatusCode >= 500 {
+		return errors.New(resp.Status)
+	}
+
+	return nil
+}
+
+// serveHealthz answers if the service is alive at all. It only
+// fails if the amqp connection is lost since the service can't
+// recover from that without a restart.
+func (c *Core) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	status := http.StatusOK
+	result := map[string]interface{}{
+		"status":  "ok",
+		"service": c.ServiceName,
+		"uptime":  time.Since(c.health.started).String(),
+	}
+
+	if c.AmqpConn == nil || c.AmqpConn.IsClosed() {
+		status = http.StatusServiceUnavailable
+		result["status"] = "fail"
+		result["error"] = "amqp connection closed"
+	}
+
+	writeJSON(w, status, result)
+}
+
+// serveReadyz runs all ready checks and answers with the result of
+// each of them.
+func (c *Core) serveReadyz(w http.ResponseWriter, r *http.Request) {
+	c.health.mutex.Lock()
+	checks := make(map[string]ReadyCheck)
+	for name, check := range c.health.checks {
+		checks[name] = check
+	}
+	c.health.mutex.Unlock()
+
+	status := http.StatusOK
+	overall := "ok"
+	results := make(map[string]*checkResult)
+
+	for name, check := range checks {
+		detail, err := check()
+
+		res := &checkResult{Status: "ok", Detail: detail}
+		if err != nil {
+			res.Status = "fail"
+			res.Error = err.Error()
+			status = http.StatusServiceUnavailable
+			overall = "fail"
+		}
+
+		results[name] = res
+	}
+
+	writeJSON(w, status, map[string]interface{}{
+		"status":  overall,
+		"service": c.ServiceName,
+		"checks":  results,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
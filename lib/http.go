@@ -0,0 +1,316 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// HTTPConfig configures timeouts, retries, and circuit breakers of
+// the shared http client. Zero values are replaced by the defaults.
+type HTTPConfig struct {
+	Timeout          int // seconds a request may take (default 120)
+	StreamTimeout    int // seconds a streamed download may take (default 1800)
+	Retries          int // retries of requests which are safe to repeat (default 3, -1 for none)
+	BackoffMin       int // milliseconds before the first retry (default 500)
+	BackoffMax       int // maximum milliseconds between retries (default 30000)
+	BreakerThreshold int // consecutive failures until a host is cut off (default 5)
+	BreakerCooldown  int // seconds until a cut off host is tried again (default 30)
+}
+
+// ErrCircuitOpen is returned for requests to hosts whose circuit
+// breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker open")
+
+// Possible states of a circuit breaker.
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// breaker cuts a host off after too many consecutive failures so we
+// don't pile up requests against a dead service. After the cooldown
+// a single trial request decides if the host is usable again.
+type breaker struct {
+	host     string
+	state    string
+	failures int
+	openedAt time.Time
+	trial    bool
+}
+
+func (c *Core) defaultHTTPConfig() *HTTPConfig {
+	return &HTTPConfig{
+		Timeout:          120,
+		StreamTimeout:    1800,
+		Retries:          3,
+		BackoffMin:       500,
+		BackoffMax:       30000,
+		BreakerThreshold: 5,
+		BreakerCooldown:  30,
+	}
+}
+
+// SetupHTTP replaces the defaults of the http layer with the
+// values set in conf. A nil conf keeps the defaults.
+func (c *Core) SetupHTTP(conf *HTTPConfig) {
+	if conf == nil {
+		return
+	}
+
+	d := c.httpConf
+	if conf.Timeout > 0 {
+		d.Timeout = conf.Timeout
+	}
+	if conf.StreamTimeout > 0 {
+		d.StreamTimeout = conf.StreamTimeout
+	}
+	if conf.Retries > 0 {
+		d.Retries = conf.Retries
+	} else if conf.Retries < 0 {
+		d.Retries = 0
+	}
+	if conf.BackoffMin > 0 {
+		d.BackoffMin = conf.BackoffMin
+	}
+	if conf.BackoffMax > 0 {
+		d.BackoffMax = conf.BackoffMax
+	}
+	if conf.BreakerThreshold > 0 {
+		d.BreakerThreshold = conf.BreakerThreshold
+	}
+	if conf.BreakerCooldown > 0 {
+		d.BreakerCooldown = conf.BreakerCooldown
+	}
+}
+
+// Do sends the request through the circuit breaker of its host. If
+// the request is safe to repeat it is retried with jittered backoff
+// on network errors and 502, 503, and 504 responses. Requests with
+// an idempotent method are always safe, all others only if safe is
+// set. The response body has to be closed by the caller.
+func (c *Core) Do(req *http.Request, safe bool) (*http.Response, error) {
+	return c.do(req, safe, time.Second*time.Duration(c.httpConf.Timeout))
+}
+
+func (c *Core) do(req *http.Request, safe bool, timeout time.Duration) (*http.Response, error) {
+	retries := 0
+	if safe || isIdempotent(req.Method) {
+		retries = c.httpConf.Retries
+	}
+
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	for attempt := 0; ; attempt++ {
+		resp, err = c.doOnce(req, timeout)
+
+		if err == ErrCircuitOpen || attempt >= retries || !shouldRetry(resp, err) {
+			return resp, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			SafeResponseClose(resp)
+		}
+
+		c.metrics.httpRetries.Inc(req.URL.Host, req.Method, endpointOf(req.URL.Path))
+
+		wait := c.backoff(attempt)
+		c.Warning.Printf("Retrying %s %s in %s (%d/%d): %s\n", req.Method, req.URL.Host+req.URL.Path, wait, attempt+1, retries, reason)
+		time.Sleep(wait)
+
+		// the body was consumed by the last try
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		} else if req.Body != nil {
+			return nil, errors.New("can't retry request with a body that can't be rewound")
+		}
+	}
+}
+
+// doOnce sends the request a single time and records the outcome
+// in the trace, the metrics, and the circuit breaker of the host.
+func (c *Core) doOnce(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if err := c.breakerAllow(req.URL.Host); err != nil {
+		return nil, err
+	}
+
+	var span *Span
+	if c.span != nil {
+		span = c.startSpan(req.Method+" "+req.URL.Host+endpointOf(req.URL.Path), 3)
+		span.Attrs["http.method"] = req.Method
+		// the query isn't added since it may contain api keys
+		span.Attrs["http.url"] = req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+		req.Header.Set(traceHeader, span.Traceparent())
+	}
+
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	resp, err := c.Client.Do(req.WithContext(ctx))
+
+	c.observeRequest(req, resp, err, time.Since(start))
+	if span != nil {
+		spanErr := err
+		if err == nil {
+			span.Attrs["http.status_code"] = fmt.Sprintf("%d", resp.StatusCode)
+			if resp.StatusCode >= 500 {
+				spanErr = errors.New(resp.Status)
+			}
+		}
+		span.End(spanErr)
+	}
+	c.breakerRecord(req.URL.Host, err == nil && resp.StatusCode < 500)
+
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// the timeout has to stay active until the body is read
+	resp.Body = &cancelOnClose{resp.Body, cancel}
+	return resp, nil
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// backoff returns the time to wait before the given retry. The
+// delay doubles with every attempt and is jittered by up to 50%.
+func (c *Core) backoff(attempt int) time.Duration {
+	delay := float64(c.httpConf.BackoffMin) * float64(uint(1)<<uint(attempt))
+	if delay > float64(c.httpConf.BackoffMax) {
+		delay = float64(c.httpConf.BackoffMax)
+	}
+
+	delay = delay/2 + rand.Float64()*delay/2
+	return time.Duration(delay) * time.Millisecond
+}
+
+func isIdempotent(method string) bool {
+	switch method {
+	case "GET", "HEAD", "OPTIONS", "PUT", "DELETE":
+		return true
+	}
+
+	return false
+}
+
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch resp.StatusCode {
+	case 502, 503, 504:
+		return true
+	}
+
+	return false
+}
+
+// breakerAllow checks if a request to host may be sent.
+func (c *Core) breakerAllow(host string) error {
+	c.breakerMutex.Lock()
+	defer c.breakerMutex.Unlock()
+
+	b := c.breaker(host)
+
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < time.Second*time.Duration(c.httpConf.BreakerCooldown) {
+			return ErrCircuitOpen
+		}
+
+		b.state = BreakerHalfOpen
+		b.trial = true
+		c.Info.Println("Circuit breaker half-open, sending a trial request to", host)
+		return nil
+
+	case BreakerHalfOpen:
+		// only one trial request at a time
+		if b.trial {
+			return ErrCircuitOpen
+		}
+
+		b.trial = true
+	}
+
+	return nil
+}
+
+// breakerRecord updates the breaker of host with the outcome of
+// a request.
+func (c *Core) breakerRecord(host string, success bool) {
+	c.breakerMutex.Lock()
+	defer c.breakerMutex.Unlock()
+
+	b := c.breaker(host)
+	b.trial = false
+
+	if success {
+		if b.state != BreakerClosed {
+			c.Info.Println("Circuit breaker closed, host is back:", host)
+		}
+
+		b.state = BreakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures += 1
+
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= c.httpConf.BreakerThreshold) {
+		c.Warning.Printf("Circuit breaker opened for %s after %d failures\n", host, b.failures)
+		b.state = BreakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// breaker returns the breaker of host. The breaker mutex has to
+// be held by the caller.
+func (c *Core) breaker(host string) *breaker {
+	b, exists := c.breakers[host]
+	if !exists {
+		b = &breaker{host: host, state: BreakerClosed}
+		c.breakers[host] = b
+	}
+
+	return b
+}
+
+// BreakerStates returns the state of the circuit breaker of every
+// host contacted so far.
+func (c *Core) BreakerStates() map[string]string {
+	c.breakerMutex.Lock()
+	defer c.breakerMutex.Unlock()
+
+	states := make(map[string]string)
+	for host, b := range c.breakers {
+		states[host] = b.state
+	}
+
+	return states
+}
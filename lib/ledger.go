@@ -0,0 +1,140 @@
+package lib
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Ledger is a small persistent key value store used to remember
+// which steps of a message are already done, so a retry of the
+// message can skip them. Every key is stored in its own file. All
+// methods can be called on a nil Ledger, which remembers nothing.
+type Ledger struct {
+	dir   string
+	mutex *sync.Mutex
+}
+
+type ledgerEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// OpenLedger opens (and if needed creates) the ledger in dir. An
+// empty dir returns a nil Ledger.
+func (c *Core) OpenLedger(dir string) *Ledger {
+	if dir == "" {
+		return nil
+	}
+
+	err := os.MkdirAll(dir, 0700)
+	c.FailOnError(err, "Couldn't create the ledger dir!")
+
+	c.Debug.Println("Using ledger in", dir)
+
+	return &Ledger{
+		dir:   dir,
+		mutex: &sync.Mutex{},
+	}
+}
+
+func (l *Ledger) path(key string) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%x", sha1.Sum([]byte(key))))
+}
+
+// Get returns the value stored for key.
+func (l *Ledger) Get(key string) (string, bool) {
+	if l == nil {
+		return "", false
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	content, err := ioutil.ReadFile(l.path(key))
+	if err != nil {
+		return "", false
+	}
+
+	e := &ledgerEntry{}
+	if err = json.Unmarshal(content, e); err != nil || e.Key != key {
+		return "", false
+	}
+
+	return e.Value, true
+}
+
+// Set stores value for key. The file is replaced atomically so a
+// crash never leaves a half written entry behind.
+func (l *Ledger) Set(key, value string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	content, err := json.Marshal(&ledgerEntry{key, value})
+	if err != nil {
+		return err
+	}
+
+	fileName := l.path(key)
+	if err = ioutil.WriteFile(fileName+".tmp", content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// Delete removes key from the ledger.
+func (l *Ledger) Delete(key string) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	err := os.Remove(l.path(key))
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	return err
+}
+
+// Expire removes all entries which weren't written for maxAge
+// and returns the number of removed entries.
+func (l *Ledger) Expire(maxAge time.Duration) (int, error) {
+	if l == nil {
+		return 0, nil
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	files, err := ioutil.ReadDir(l.dir)
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for _, f := range files {
+		if f.IsDir() || time.Since(f.ModTime()) < maxAge {
+			continue
+		}
+
+		if err = os.Remove(filepath.Join(l.dir, f.Name())); err != nil {
+			return removed, err
+		}
+		removed += 1
+	}
+
+	return removed, nil
+}
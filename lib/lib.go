@@ -8,9 +8,12 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/streadway/amqp"
 )
@@ -26,23 +29,62 @@ type Core struct {
 	Client      *http.Client
 	ServiceName string
 
-	failed *QueueHandler
+	// Ledger is used to remember finished steps of messages, it
+	// is nil unless the service opened one.
+	Ledger *Ledger
+
+	// Metrics holds the metrics served by StartMonitor, services
+	// can register their own metrics on it.
+	Metrics *Metrics
+
+	failed        *QueueHandler
+	metrics       *coreMetrics
+	health        *health
+	logSink       *logSink
+	logLevel      string
+	logFields     Fields
+	tracer        *tracer
+	span          *Span
+	httpConf      *HTTPConfig
+	breakers      map[string]*breaker
+	breakerMutex  *sync.Mutex
+	limiterConf   *RateLimitConfig
+	limiters      map[string]*RateLimiter
+	limiterMutex  *sync.Mutex
+	credentials   *credentials
+	security      *security
+	critsAllowed  *allowList
+	cuckooAllowed *allowList
 }
 
+// FailedMsg is the amqp msg sent to the overseer for every msg
+// a service failed to handle. Msg holds the original message.
 type FailedMsg struct {
-	Service string
-	Queue   string
-	Error   string
-	Desc    string
-	Msg     string
+	Service   string `json:"service"`
+	Queue     string `json:"queue"`
+	Error     string `json:"error"`
+	Desc      string `json:"desc"`
+	Msg       string `json:"msg"`
+	Code      string `json:"code"`              // one of the Err* codes
+	Retryable bool   `json:"retryable"`         // resubmitting the msg may succeed
+	Stage     string `json:"stage,omitempty"`   // service to restart from, empty for the failed one
+	Restart   string `json:"restart,omitempty"` // msg sent to Stage instead of Msg
 }
 
 type QueueHandler struct {
 	Queue   string
 	Channel *amqp.Channel
 	C       *Core
+
+	// delay queues only, see Delayed
+	deliverTo string
+	args      amqp.Table
 }
 
+// AttemptHeader carries the number of times a message was
+// resubmitted by the overseer.
+const AttemptHeader = "x-attempt"
+
 // DistributedCuckooReq is the amqp msg sent from crits to feed_cuckoo
 type DistributedCuckooReq struct {
 	Payload   map[string]string `json:"payload"`
@@ -52,16 +94,18 @@ type DistributedCuckooReq struct {
 
 // FeedCuckooReq is the amqp msg sent from feed_cuckoo to check_results
 type FeedCuckooReq struct {
-	TaskId    int
-	CuckooURL string
-	CritsData *CritsData
+	TaskId    int               `json:"task_id"`
+	CuckooURL string            `json:"cuckoo_url"`
+	CritsData *CritsData        `json:"crits_data"`
+	Payload   map[string]string `json:"payload"`
 }
 
 // CheckResultsReq is the amqp msg sent from check_results to parse_and_submit
 type CheckResultsReq struct {
-	CuckooURL string
-	TaskId    int
-	CritsData *CritsData
+	CuckooURL string            `json:"cuckoo_url"`
+	TaskId    int               `json:"task_id"`
+	CritsData *CritsData        `json:"crits_data"`
+	Payload   map[string]string `json:"payload"`
 }
 
 // critsData contains the most important data about a analysis handled
@@ -73,7 +117,7 @@ type CritsData struct {
 	ObjectType string `json:"object_type"`
 	ObjectId   string `json:"object_id"`
 	Username   string `json:"username"`
-	ApiKey     string `json:"api_key"`
+	ApiKey     string `json:"api_key,omitempty"` // only in legacy messages, see CritsCredential
 	MD5        string `json:"md5"`
 	Source     string `json:"source"`
 }
@@ -81,12 +125,16 @@ type CritsData struct {
 // Init creates a new Core struct containing all the necessary information.
 // The function also initializes loggin, the amqp connection, the failed
 // queue, and HTTP client.
-func Init(service, amqpConnectionPath, logPath, logLevel, failedQueue string, verifySSL bool) *Core {
+func Init(service, amqpConnectionPath string, logConf *LogConfig, failedQueue string, verifySSL bool) *Core {
 	var err error
 	c := &Core{}
 
-	c.setupLogging(logPath, logLevel)
+	c.setupLogging(logConf)
+	c = c.With(Fields{"service": service})
+	c.setupMetrics()
+	c.setupHealth()
 	c.ServiceName = service
+	c.setupTracing()
 
 	c.Info.Println("Connecting to amqp server...")
 	c.AmqpConn, err = amqp.Dial(amqpConnectionPath)
@@ -99,53 +147,32 @@ func Init(service, amqpConnectionPath, logPath, logLevel, failedQueue string, ve
 	return c
 }
 
-// setupLogging populates the info and warning logger.
-func (c *Core) setupLogging(file, level string) {
-	// default: only log to stdout
-	handler := io.MultiWriter(os.Stdout)
-
-	if file != "" {
-		// log to file
-		if _, err := os.Stat(file); os.IsNotExist(err) {
-			err := ioutil.WriteFile(file, []byte(""), 0600)
-			c.FailOnError(err, "Couldn't create the log!")
-		}
-
-		f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
-		c.FailOnError(err, "Failed to open log file!")
-
-		handler = io.MultiWriter(f, os.Stdout)
-	}
-
-	// TODO: make this nicer....
-	empty := io.MultiWriter()
-	if level == "warning" {
-		c.Warning = log.New(handler, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-		c.Info = log.New(empty, "INFO: ", log.Ldate|log.Ltime)
-		c.Debug = log.New(empty, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
-	} else if level == "info" {
-		c.Warning = log.New(handler, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-		c.Info = log.New(handler, "INFO: ", log.Ldate|log.Ltime)
-		c.Debug = log.New(empty, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
-	} else {
-		c.Warning = log.New(handler, "WARNING: ", log.Ldate|log.Ltime|log.Lshortfile)
-		c.Info = log.New(handler, "INFO: ", log.Ldate|log.Ltime)
-		c.Debug = log.New(handler, "DEBUG: ", log.Ldate|log.Ltime|log.Lshortfile)
-	}
-}
-
 // setupClient populates the http client so we have one client
 // which can keep the connections open so there is no need to
-// start a new connection for each request.
+// start a new connection for each request. Timeouts, retries,
+// and circuit breakers are handled by Do and can be changed
+// via SetupHTTP.
 func (c *Core) setupClient(verifySSL bool) {
-	tr := &http.Transport{}
+	tr := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		IdleConnTimeout:     90 * time.Second,
+	}
 	if !verifySSL {
-		tr = &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
+		tr.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
 
 	c.Client = &http.Client{Transport: tr}
+	c.httpConf = c.defaultHTTPConfig()
+	c.breakers = make(map[string]*breaker)
+	c.breakerMutex = &sync.Mutex{}
+	c.limiterConf = c.defaultRateLimitConfig()
+	c.limiters = make(map[string]*RateLimiter)
+	c.limiterMutex = &sync.Mutex{}
 }
 
 // SetupQueue creates a new channel on top of the established
@@ -171,24 +198,97 @@ func (c *Core) SetupQueue(queue string) *QueueHandler {
 	)
 	c.FailOnError(err, "Failed to declare queue")
 
-	return &QueueHandler{queue, channel, c}
+	c.watchChannel(queue, channel)
+
+	return &QueueHandler{queue, channel, c, "", nil}
+}
+
+// For returns a copy of the QueueHandler which logs with c and
+// passes the trace of c on to the receiver of the messages.
+func (q *QueueHandler) For(c *Core) *QueueHandler {
+	return &QueueHandler{q.Queue, q.Channel, c, q.deliverTo, q.args}
+}
+
+// Delayed returns a QueueHandler whose messages are delivered to q
+// after delay. They wait in a queue with a TTL which dead-letters
+// them into q. The broker removes the delay queue once it's unused.
+func (q *QueueHandler) Delayed(delay time.Duration) *QueueHandler {
+	ttl := int64(delay / time.Millisecond)
+
+	return &QueueHandler{
+		fmt.Sprintf("%s.delay.%dms", q.Queue, ttl),
+		q.Channel,
+		q.C,
+		q.Queue,
+		amqp.Table{
+			"x-message-ttl":             ttl,
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": q.Queue,
+			"x-expires":                 ttl*2 + 60000,
+		},
+	}
 }
 
 // Send is used to send a message to a amqp
 // queue. Channel and queue name are taken from
 // the QueueHandler struct.
 func (q *QueueHandler) Send(msg []byte) {
-	err := q.Channel.Publish(
+	q.SendHeaders(msg, nil)
+}
+
+// Forward sends msg, the message which follows from, to the next
+// stage. The attempt of from is passed on in the AttemptHeader.
+func (q *QueueHandler) Forward(msg []byte, from *amqp.Delivery) {
+	headers := amqp.Table{}
+	if attempt := AttemptOf(from); attempt > 0 {
+		headers[AttemptHeader] = int32(attempt)
+	}
+
+	q.SendHeaders(msg, headers)
+}
+
+// SendHeaders sends a message with additional headers.
+func (q *QueueHandler) SendHeaders(msg []byte, extra amqp.Table) {
+	headers := amqp.Table{}
+	for k, v := range extra {
+		headers[k] = v
+	}
+	if q.C.span != nil {
+		headers[traceHeader] = q.C.span.Traceparent()
+	}
+
+	// messages in a delay queue are received from the queue they
+	// are dead-lettered into, that's what the signature is for.
+	routingKey := q.Queue
+	if q.deliverTo != "" {
+		routingKey = q.deliverTo
+
+		// declaring the queue again keeps it from expiring
+		_, err := q.Channel.QueueDeclare(q.Queue, true, false, false, false, q.args)
+		q.C.FailOnError(err, "Failed to declare delay queue")
+	}
+
+	body, err := q.C.security.seal(routingKey, msg, headers)
+	q.C.FailOnError(err, "Failed to seal a message")
+
+	contentType := "text/plain"
+	if _, encrypted := headers[encryptionHeader]; encrypted {
+		contentType = "application/octet-stream"
+	}
+
+	err = q.Channel.Publish(
 		"",      // exchange
 		q.Queue, // routing key
 		false,   // mandatory
 		false,   // immediate
 		amqp.Publishing{
+			Headers:      headers,
 			DeliveryMode: amqp.Persistent,
-			ContentType:  "text/plain",
-			Body:         msg,
+			ContentType:  contentType,
+			Body:         body,
 		})
 	q.C.FailOnError(err, "Failed to publish a message")
+	q.C.metrics.published.Inc(q.Queue)
 
 	i := ""
 	if len(msg) > 700 {
@@ -228,8 +328,15 @@ func (c *Core) Consume(queue string, prefetchCount int, fn func(msg amqp.Deliver
 	forever := make(chan bool)
 
 	go func() {
+		qc := c.With(Fields{"queue": queue})
 		for m := range msgs {
-			c.Info.Println("Received a message")
+			qc.Info.Println("Received a message")
+			if err := c.security.open(&m); err != nil {
+				qc.reject(&m, err)
+				continue
+			}
+
+			c.received(&m)
 			fn(m)
 		}
 	}()
@@ -243,7 +350,12 @@ func (c *Core) Consume(queue string, prefetchCount int, fn func(msg amqp.Deliver
 func (c *Core) FastGet(url string, structPointer interface{}) ([]byte, int, error) {
 	c.Debug.Println("Getting", url)
 
-	resp, err := c.Client.Get(url)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	resp, err := c.Do(req, true)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -262,11 +374,47 @@ func (c *Core) FastGet(url string, structPointer interface{}) ([]byte, int, erro
 	return respBody, resp.StatusCode, err
 }
 
-// FastGet is a wrapper for http.PostForm which returns only
-// the important data from the request.
-func (c *Core) FastPostForm(url string, data url.Values, structPointer interface{}) ([]byte, int, error) {
+// StreamGet performs a GET request and hands the response body to
+// fn without reading it into memory first. fn is only called if the
+// server answered with 200.
+func (c *Core) StreamGet(url string, fn func(body io.Reader) error) (int, error) {
+	c.Debug.Println("Streaming", url)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.do(req, true, time.Second*time.Duration(c.httpConf.StreamTimeout))
+	if err != nil {
+		return 0, err
+	}
+	defer SafeResponseClose(resp)
+
+	if resp.StatusCode != 200 {
+		respBody, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, errors.New(fmt.Sprintf("[%d] %s", resp.StatusCode, respBody))
+	}
+
+	err = fn(resp.Body)
+
+	c.Debug.Println("Done streaming", url)
+	return resp.StatusCode, err
+}
+
+// FastPostForm is a wrapper for http.PostForm which returns only
+// the important data from the request. Set safe if posting the
+// same form twice does no harm, so the request can be retried.
+func (c *Core) FastPostForm(url string, data url.Values, structPointer interface{}, safe bool) ([]byte, int, error) {
 	c.Debug.Println("Posting from to", url)
-	resp, err := c.Client.PostForm(url, data)
+
+	req, err := http.NewRequest("POST", url, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.Do(req, safe)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -365,29 +513,40 @@ func (c *Core) FailOnError(err error, msg string) {
 // nackOnError accepts an error, error description, and amqp
 // message. If the error is not nil a NACK is send in replay
 // to the msg. The msg will be redirected to the failed queue
-// so the overseer can handle it.
+// so the overseer can handle it. The failure is classified as
+// ErrInternal, see NackWithCode.
 func (c *Core) NackOnError(err error, desc string, msg *amqp.Delivery) bool {
+	return c.NackWithCode(err, ErrInternal, desc, msg)
+}
+
+// nack sends failed, completed with the error and msg, to the
+// overseer and NACKs msg.
+func (c *Core) nack(err error, failed *FailedMsg, desc string, msg *amqp.Delivery) bool {
 	if err != nil {
-		c.Warning.Println("[NACK]", desc, err.Error())
-
-		jm, err := json.Marshal(FailedMsg{
-			c.ServiceName,
-			msg.RoutingKey,
-			err.Error(),
-			desc,
-			string(msg.Body),
-		})
+		c.Warning.Println("[NACK]", failed.Code, desc, err.Error())
+
+		failed.Service = c.ServiceName
+		failed.Queue = msg.RoutingKey
+		failed.Error = err.Error()
+		failed.Desc = desc
+		failed.Msg = string(msg.Body)
+
+		jm, err := c.NewEnvelope(MsgTypeFailed, failed)
 		if err != nil {
 			c.Warning.Println(err.Error())
 		}
 
-		c.failed.Send(jm)
+		// the overseer counts the attempts with this header
+		c.failed.For(c).Forward(jm, msg)
 
 		err = msg.Nack(false, false)
 		if err != nil {
 			c.Warning.Println("Sending NACK failed!", err.Error())
 		}
 
+		c.metrics.nacked.Inc(msg.RoutingKey)
+		c.handled(msg, "nacked", errors.New(desc))
+
 		return true
 	}
 
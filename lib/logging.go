@@ -0,0 +1,317 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// LogConfig configures the logging of a service.
+type LogConfig struct {
+	File       string // log file, empty to log to stdout only
+	Level      string // debug, info, or warning
+	Format     string // text (default), json, or logfmt
+	MaxSize    int    // rotate the log file after this many MB, 0 to never rotate
+	MaxBackups int    // number of rotated files to keep (default 5)
+}
+
+// Fields are attached to every line logged by a Core, see With.
+type Fields map[string]interface{}
+
+// logFileMode are the permissions of new log files.
+const logFileMode = 0640
+
+// logSink formats log lines and writes them to stdout and the
+// log file. It is shared by all scoped Cores of a service.
+type logSink struct {
+	format string
+	out    io.Writer
+	mutex  *sync.Mutex
+}
+
+// levelWriter is the writer behind one of the loggers of a Core.
+// Every line written to it is formatted with the level and fields.
+type levelWriter struct {
+	sink   *logSink
+	level  string
+	fields Fields
+}
+
+// setupLogging populates the debug, info, and warning logger.
+func (c *Core) setupLogging(conf *LogConfig) {
+	if conf == nil {
+		conf = &LogConfig{}
+	}
+
+	// default: only log to stdout
+	var out io.Writer = os.Stdout
+
+	if conf.File != "" {
+		f, err := openRotating(conf.File, conf.MaxSize, conf.MaxBackups)
+		if err != nil {
+			panic("Failed to open log file! " + err.Error())
+		}
+
+		out = io.MultiWriter(f, os.Stdout)
+	}
+
+	format := conf.Format
+	if format != "json" && format != "logfmt" {
+		format = "text"
+	}
+
+	c.logSink = &logSink{format: format, out: out, mutex: &sync.Mutex{}}
+	c.logLevel = conf.Level
+	c.logFields = Fields{}
+	c.setupLoggers()
+}
+
+// setupLoggers creates the loggers for the level and fields of c.
+func (c *Core) setupLoggers() {
+	logger := func(level string, enabled bool) *log.Logger {
+		if !enabled {
+			return log.New(ioutil.Discard, "", 0)
+		}
+
+		return log.New(&levelWriter{c.logSink, level, c.logFields}, "", 0)
+	}
+
+	c.Warning = logger("warning", true)
+	c.Info = logger("info", c.logLevel != "warning")
+	c.Debug = logger("debug", c.logLevel != "warning" && c.logLevel != "info")
+}
+
+// With returns a copy of c which attaches fields to every line it
+// logs. Everything else, like connections and metrics, is shared.
+func (c *Core) With(fields Fields) *Core {
+	scoped := *c
+
+	scoped.logFields = Fields{}
+	for k, v := range c.logFields {
+		scoped.logFields[k] = v
+	}
+	for k, v := range fields {
+		scoped.logFields[k] = v
+	}
+
+	scoped.setupLoggers()
+	return &scoped
+}
+
+// WithMsg returns a copy of c which logs the queue of msg and the
+// given analysis. Empty values are left out. Http requests and
+// messages sent with the copy continue the trace of msg.
+func (c *Core) WithMsg(msg *amqp.Delivery, data *CritsData, taskId int, cuckooURL string) *Core {
+	fields := Fields{}
+
+	if msg != nil && msg.RoutingKey != "" {
+		fields["queue"] = msg.RoutingKey
+	}
+	if data != nil {
+		fields["analysis_id"] = data.AnalysisId
+		fields["object_id"] = data.ObjectId
+	}
+	if taskId != 0 {
+		fields["task_id"] = taskId
+	}
+	if cuckooURL != "" {
+		fields["cuckoo_url"] = cuckooURL
+	}
+
+	span := c.span
+	if msg != nil {
+		if s := c.msgSpan(msg); s != nil {
+			span = s
+		}
+	}
+	if span != nil {
+		fields["trace_id"] = span.TraceId
+	}
+
+	scoped := c.With(fields)
+	scoped.span = span
+	return scoped
+}
+
+func (w *levelWriter) Write(p []byte) (int, error) {
+	// Write <- log.Logger.output <- Println / Printf <- caller
+	caller := ""
+	if _, file, line, ok := runtime.Caller(3); ok {
+		caller = fmt.Sprintf("%s:%d", filepath.Base(file), line)
+	}
+
+	msg := Redact(strings.TrimRight(string(p), "\n"))
+	if err := w.sink.write(w.level, msg, caller, w.fields); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// write formats a single line and writes it to the outputs.
+func (s *logSink) write(level, msg, caller string, fields Fields) error {
+	now := time.Now()
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := &strings.Builder{}
+	switch s.format {
+	case "json":
+		b.WriteString("{")
+		fmt.Fprintf(b, `"time":%s,"level":%s,"msg":%s`, jsonString(now.Format(time.RFC3339Nano)), jsonString(level), jsonString(msg))
+		if caller != "" {
+			fmt.Fprintf(b, `,"caller":%s`, jsonString(caller))
+		}
+		for _, k := range keys {
+			v, err := json.Marshal(fields[k])
+			if err != nil {
+				v = []byte(jsonString(fmt.Sprint(fields[k])))
+			}
+			v = []byte(Redact(string(v)))
+			fmt.Fprintf(b, `,%s:%s`, jsonString(k), v)
+		}
+		b.WriteString("}\n")
+
+	case "logfmt":
+		fmt.Fprintf(b, "time=%s level=%s msg=%s", now.Format(time.RFC3339Nano), level, logfmtValue(msg))
+		if caller != "" {
+			fmt.Fprintf(b, " caller=%s", logfmtValue(caller))
+		}
+		for _, k := range keys {
+			fmt.Fprintf(b, " %s=%s", k, logfmtValue(Redact(fmt.Sprint(fields[k]))))
+		}
+		b.WriteString("\n")
+
+	default:
+		// the format used before structured logging
+		fmt.Fprintf(b, "%s: %s ", strings.ToUpper(level), now.Format("2006/01/02 15:04:05"))
+		if caller != "" && level != "info" {
+			fmt.Fprintf(b, "%s: ", caller)
+		}
+		b.WriteString(msg)
+		for _, k := range keys {
+			fmt.Fprintf(b, " %s=%s", k, logfmtValue(Redact(fmt.Sprint(fields[k]))))
+		}
+		b.WriteString("\n")
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, err := io.WriteString(s.out, b.String())
+	return err
+}
+
+func jsonString(s string) string {
+	j, _ := json.Marshal(s)
+	return string(j)
+}
+
+// logfmtValue quotes v if needed.
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \"=\t\n\r\\") {
+		return strconv.Quote(v)
+	}
+
+	return v
+}
+
+// rotatingFile is a log file which is rotated once it grows bigger
+// than maxSize. Rotated files are renamed to file.1, file.2, ...
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	size       int64
+	file       *os.File
+	mutex      *sync.Mutex
+}
+
+func openRotating(path string, maxSizeMB, maxBackups int) (*rotatingFile, error) {
+	if maxBackups <= 0 {
+		maxBackups = 5
+	}
+
+	f := &rotatingFile{
+		path:       path,
+		maxSize:    int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		mutex:      &sync.Mutex{},
+	}
+
+	return f, f.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, logFileMode)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	// files created before were world writable
+	if info.Mode().Perm()&0022 != 0 {
+		file.Chmod(logFileMode)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize && f.size > 0 {
+		if err := f.rotate(); err != nil {
+			// keep logging to the old file rather than losing lines
+			fmt.Fprintln(os.Stderr, "Rotating the log failed!", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate shifts the backups by one and starts a new file. The
+// mutex has to be held by the caller.
+func (f *rotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+
+	os.Remove(fmt.Sprintf("%s.%d", f.path, f.maxBackups))
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.path, i), fmt.Sprintf("%s.%d", f.path, i+1))
+	}
+
+	if err := os.Rename(f.path, f.path+".1"); err != nil {
+		f.open()
+		return err
+	}
+
+	return f.open()
+}
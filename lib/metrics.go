@@ -0,0 +1,263 @@
+package lib
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Buckets used by the histograms of the lib, in seconds.
+var (
+	HTTPBuckets    = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	HandlerBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 1800, 3600}
+)
+
+// metricsPrefix is prepended to the name of every metric.
+const metricsPrefix = "cuckoo_distributed_"
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Metrics is a minimal registry of counters, gauges, and histograms
+// which can be written in the prometheus text format.
+type Metrics struct {
+	mutex    *sync.Mutex
+	metrics  []*metric
+	names    map[string]bool
+	collects []func()
+}
+
+type metric struct {
+	name    string
+	help    string
+	kind    string // counter, gauge, or histogram
+	labels  []string
+	buckets []float64
+	mutex   *sync.Mutex
+	series  map[string]*series
+}
+
+type series struct {
+	values []string
+	value  float64  // counter and gauge
+	counts []uint64 // histogram, one per bucket
+	sum    float64
+	count  uint64
+}
+
+// Counter is a value which only goes up, e.g. handled messages.
+type Counter struct{ m *metric }
+
+// Gauge is a value which can go up and down, e.g. pending tasks.
+type Gauge struct{ m *metric }
+
+// Histogram counts observations, e.g. durations, in buckets.
+type Histogram struct{ m *metric }
+
+func newMetrics() *Metrics {
+	return &Metrics{
+		mutex: &sync.Mutex{},
+		names: make(map[string]bool),
+	}
+}
+
+func (r *Metrics) register(name, help, kind string, buckets []float64, labels []string) *metric {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	name = metricsPrefix + name
+	if r.names[name] {
+		panic("metric registered twice: " + name)
+	}
+	r.names[name] = true
+
+	m := &metric{
+		name:    name,
+		help:    help,
+		kind:    kind,
+		labels:  labels,
+		buckets: buckets,
+		mutex:   &sync.Mutex{},
+		series:  make(map[string]*series),
+	}
+	r.metrics = append(r.metrics, m)
+
+	return m
+}
+
+// NewCounter registers a counter with the given label names.
+func (r *Metrics) NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{r.register(name, help, "counter", nil, labels)}
+}
+
+// NewGauge registers a gauge with the given label names.
+func (r *Metrics) NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{r.register(name, help, "gauge", nil, labels)}
+}
+
+// NewHistogram registers a histogram with the given upper bounds
+// of the buckets and label names.
+func (r *Metrics) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{r.register(name, help, "histogram", buckets, labels)}
+}
+
+// OnCollect registers fn to be called before the metrics are
+// written, e.g. to update gauges which are expensive to track.
+func (r *Metrics) OnCollect(fn func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.collects = append(r.collects, fn)
+}
+
+// get returns the series with the given label values. The mutex
+// of the metric has to be held by the caller.
+func (m *metric) get(values []string) *series {
+	if len(values) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s needs %d label values, got %d", m.name, len(m.labels), len(values)))
+	}
+
+	key := strings.Join(values, "\xff")
+	s, exists := m.series[key]
+	if !exists {
+		s = &series{values: values}
+		if m.kind == "histogram" {
+			s.counts = make([]uint64, len(m.buckets))
+		}
+		m.series[key] = s
+	}
+
+	return s
+}
+
+// Inc adds one to the counter.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the counter.
+func (c *Counter) Add(v float64, values ...string) {
+	c.m.mutex.Lock()
+	defer c.m.mutex.Unlock()
+
+	c.m.get(values).value += v
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.m.mutex.Lock()
+	defer g.m.mutex.Unlock()
+
+	g.m.get(values).value = v
+}
+
+// Reset removes all series of the gauge, e.g. before setting the
+// gauges of a set of hosts which can shrink.
+func (g *Gauge) Reset() {
+	g.m.mutex.Lock()
+	defer g.m.mutex.Unlock()
+
+	g.m.series = make(map[string]*series)
+}
+
+// Observe adds v to the histogram.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.m.mutex.Lock()
+	defer h.m.mutex.Unlock()
+
+	s := h.m.get(values)
+	for i, upper := range h.m.buckets {
+		if v <= upper {
+			s.counts[i] += 1
+		}
+	}
+	s.sum += v
+	s.count += 1
+}
+
+// WriteTo writes all metrics in the prometheus text format.
+func (r *Metrics) WriteTo(w io.Writer) (int64, error) {
+	r.mutex.Lock()
+	collects := r.collects
+	metrics := r.metrics
+	r.mutex.Unlock()
+
+	for _, fn := range collects {
+		fn()
+	}
+
+	var written int64
+	for _, m := range metrics {
+		n, err := io.WriteString(w, m.text())
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// text returns the metric in the prometheus text format.
+func (m *metric) text() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	keys := make([]string, 0, len(m.series))
+	for k := range m.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := &strings.Builder{}
+	fmt.Fprintf(b, "# HELP %s %s\n", m.name, m.help)
+	fmt.Fprintf(b, "# TYPE %s %s\n", m.name, m.kind)
+
+	for _, k := range keys {
+		s := m.series[k]
+
+		if m.kind != "histogram" {
+			fmt.Fprintf(b, "%s%s %s\n", m.name, m.labelText(s.values, ""), formatFloat(s.value))
+			continue
+		}
+
+		for i, upper := range m.buckets {
+			fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, m.labelText(s.values, formatFloat(upper)), s.counts[i])
+		}
+		fmt.Fprintf(b, "%s_bucket%s %d\n", m.name, m.labelText(s.values, "+Inf"), s.count)
+		fmt.Fprintf(b, "%s_sum%s %s\n", m.name, m.labelText(s.values, ""), formatFloat(s.sum))
+		fmt.Fprintf(b, "%s_count%s %d\n", m.name, m.labelText(s.values, ""), s.count)
+	}
+
+	return b.String()
+}
+
+// labelText formats the labels of a series, le is added for the
+// buckets of histograms.
+func (m *metric) labelText(values []string, le string) string {
+	pairs := []string{}
+	for i, l := range m.labels {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", l, labelEscaper.Replace(values[i])))
+	}
+
+	if le != "" {
+		pairs = append(pairs, fmt.Sprintf("le=\"%s\"", le))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
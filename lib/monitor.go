@@ -0,0 +1,182 @@
+package lib
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// coreMetrics are the metrics recorded by the lib for every
+// service. Services can register their own metrics on c.Metrics.
+type coreMetrics struct {
+	consumed        *Counter
+	acked           *Counter
+	nacked          *Counter
+	rejected        *Counter
+	published       *Counter
+	handlerDuration *Histogram
+	httpRequests    *Counter
+	httpDuration    *Histogram
+	httpRetries     *Counter
+	breakerState    *Gauge
+
+	// messages which are not acked yet
+	inflight      map[string]*inflightMsg
+	inflightMutex *sync.Mutex
+}
+
+type inflightMsg struct {
+	received time.Time
+	span     *Span
+}
+
+// idSegment matches path segments which are ids, like cuckoo
+// task ids or crits object ids, so they don't end up as labels.
+var idSegment = regexp.MustCompile(`^([0-9]+|[0-9a-fA-F]{24,})$`)
+
+func (c *Core) setupMetrics() {
+	m := newMetrics()
+
+	c.Metrics = m
+	c.metrics = &coreMetrics{
+		consumed:        m.NewCounter("messages_consumed_total", "Messages received from a queue.", "queue"),
+		acked:           m.NewCounter("messages_acked_total", "Messages acknowledged after handling them.", "queue"),
+		nacked:          m.NewCounter("messages_nacked_total", "Messages rejected and sent to the failed queue.", "queue"),
+		rejected:        m.NewCounter("messages_rejected_total", "Messages dropped because of a missing or invalid signature.", "queue"),
+		published:       m.NewCounter("messages_published_total", "Messages sent to a queue.", "queue"),
+		handlerDuration: m.NewHistogram("message_handling_seconds", "Time from receiving a message until it was acked or nacked.", HandlerBuckets, "queue", "outcome"),
+		httpRequests:    m.NewCounter("http_requests_total", "HTTP requests by endpoint and status code, code is \"error\" if no response was received.", "host", "method", "endpoint", "code"),
+		httpDuration:    m.NewHistogram("http_request_seconds", "Duration of HTTP requests until the response headers arrived.", HTTPBuckets, "host", "method", "endpoint"),
+		httpRetries:     m.NewCounter("http_retries_total", "Retried HTTP requests.", "host", "method", "endpoint"),
+		breakerState:    m.NewGauge("http_circuit_breaker_state", "1 for the current state of the circuit breaker of each host.", "host", "state"),
+		inflight:        make(map[string]*inflightMsg),
+		inflightMutex:   &sync.Mutex{},
+	}
+
+	m.OnCollect(func() {
+		c.metrics.breakerState.Reset()
+		for host, state := range c.BreakerStates() {
+			for _, s := range []string{BreakerClosed, BreakerOpen, BreakerHalfOpen} {
+				v := 0.0
+				if s == state {
+					v = 1
+				}
+				c.metrics.breakerState.Set(v, host, s)
+			}
+		}
+	})
+}
+
+// StartMonitor serves the metrics on http://addr/metrics in the
+// prometheus text format, a liveness check on /healthz, and the
+// ready checks on /readyz. An empty addr disables the server.
+func (c *Core) StartMonitor(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		c.Metrics.WriteTo(w)
+	})
+	mux.HandleFunc("/healthz", c.serveHealthz)
+	mux.HandleFunc("/readyz", c.serveReadyz)
+
+	listener, err := net.Listen("tcp", addr)
+	c.FailOnError(err, "Couldn't start the monitor server!")
+
+	c.Info.Println("Serving metrics and health checks on", addr)
+
+	go func() {
+		err := http.Serve(listener, mux)
+		c.FailOnError(err, "Monitor server failed!")
+	}()
+}
+
+// Ack acknowledges the message and records how long it took to
+// handle it.
+func (c *Core) Ack(msg *amqp.Delivery) {
+	if err := msg.Ack(false); err != nil {
+		c.Warning.Println("Sending ACK failed!", err.Error())
+	}
+
+	c.metrics.acked.Inc(msg.RoutingKey)
+	c.handled(msg, "acked", nil)
+}
+
+func deliveryKey(msg *amqp.Delivery) string {
+	return fmt.Sprintf("%s/%d", msg.ConsumerTag, msg.DeliveryTag)
+}
+
+// received remembers when a message was received and starts the
+// span of its handling.
+func (c *Core) received(msg *amqp.Delivery) {
+	c.metrics.consumed.Inc(msg.RoutingKey)
+
+	c.metrics.inflightMutex.Lock()
+	c.metrics.inflight[deliveryKey(msg)] = &inflightMsg{time.Now(), c.consumeSpan(msg)}
+	c.metrics.inflightMutex.Unlock()
+}
+
+// handled records the time it took to handle the message and ends
+// its span.
+func (c *Core) handled(msg *amqp.Delivery, outcome string, err error) {
+	key := deliveryKey(msg)
+
+	c.metrics.inflightMutex.Lock()
+	m, exists := c.metrics.inflight[key]
+	delete(c.metrics.inflight, key)
+	c.metrics.inflightMutex.Unlock()
+
+	if exists {
+		c.metrics.handlerDuration.Observe(time.Since(m.received).Seconds(), msg.RoutingKey, outcome)
+
+		m.span.Attrs["outcome"] = outcome
+		m.span.End(err)
+	}
+}
+
+// msgSpan returns the span of a message which is being handled.
+func (c *Core) msgSpan(msg *amqp.Delivery) *Span {
+	c.metrics.inflightMutex.Lock()
+	defer c.metrics.inflightMutex.Unlock()
+
+	if m, exists := c.metrics.inflight[deliveryKey(msg)]; exists {
+		return m.span
+	}
+
+	return nil
+}
+
+// observeRequest records the outcome of a single http request.
+func (c *Core) observeRequest(req *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+	endpoint := endpointOf(req.URL.Path)
+
+	code := "error"
+	if err == nil {
+		code = fmt.Sprintf("%d", resp.StatusCode)
+	}
+
+	c.metrics.httpRequests.Inc(req.URL.Host, req.Method, endpoint, code)
+	c.metrics.httpDuration.Observe(elapsed.Seconds(), req.URL.Host, req.Method, endpoint)
+}
+
+// endpointOf replaces the ids in path so requests to the same
+// endpoint share their metrics.
+func endpointOf(path string) string {
+	segments := strings.Split(path, "/")
+	for i, s := range segments {
+		if idSegment.MatchString(s) {
+			segments[i] = ":id"
+		}
+	}
+
+	return strings.Join(segments, "/")
+}
@@ -0,0 +1,252 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Parser turns (parts of) a cuckoo report into crits results.
+// Parsers register themselves via RegisterParser and are selected
+// by name through the EnabledParsers option of parse_and_submit.
+type Parser interface {
+	// Name is the name used in the EnabledParsers option.
+	Name() string
+
+	// Sections lists the report sections the parser reads. Parsers
+	// which don't need the report return nil. Parse has to cope
+	// with some of the sections missing in the report.
+	Sections() []string
+
+	// Parse extracts the results from the report. On error the
+	// results gathered so far may be returned alongside the error.
+	Parse(report *CkoTasksReport, ctx *ParserContext) ([]*CrtResult, error)
+}
+
+// OrderedParser can be implemented by parsers which have to run
+// before or after the others. Parsers are sorted by Order (lower
+// runs first, the default is 0) and then by their position in
+// the EnabledParsers option.
+type OrderedParser interface {
+	Parser
+	Order() int
+}
+
+// ParserContext holds everything a parser might need besides the
+// report itself.
+type ParserContext struct {
+	C      *Core
+	Req    *CheckResultsReq
+	Cuckoo *CuckooConn
+	Crits  *CritsConn
+
+	// Results contains the results of all parsers which ran before.
+	Results []*CrtResult
+}
+
+// StepKey returns the ledger key of a step of the current analysis.
+// Keys are unique per crits analysis and cuckoo task.
+func (ctx *ParserContext) StepKey(step string) string {
+	return fmt.Sprintf("%s/%d/%s", ctx.Crits.Data.AnalysisId, ctx.Req.TaskId, step)
+}
+
+// Done checks if the step was already completed for the current
+// analysis and returns the value stored by MarkDone.
+func (ctx *ParserContext) Done(step string) (string, bool) {
+	return ctx.C.Ledger.Get(ctx.StepKey(step))
+}
+
+// MarkDone records the step as completed for the current analysis,
+// so a retry of the same message can skip it. value can be used to
+// remember the outcome of the step, e.g. the id of a new object.
+func (ctx *ParserContext) MarkDone(step, value string) {
+	if err := ctx.C.Ledger.Set(ctx.StepKey(step), value); err != nil {
+		ctx.C.Warning.Println("Couldn't record step in ledger!", step, err)
+	}
+}
+
+// FatalError is returned by parsers whose failure should abort the
+// whole analysis instead of only the parser itself.
+type FatalError struct {
+	Err error
+}
+
+func (e *FatalError) Error() string {
+	return e.Err.Error()
+}
+
+// Fatal wraps err into a FatalError.
+func Fatal(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &FatalError{err}
+}
+
+// ParserError is returned by RunParsers if a parser failed, as
+// opposed to adding the results to crits.
+type ParserError struct {
+	Parser string
+	Err    error
+	Fatal  bool // the parser returned a FatalError
+}
+
+func (e *ParserError) Error() string {
+	return fmt.Sprintf("parser %s: %s", e.Parser, e.Err)
+}
+
+var (
+	parserMutex = &sync.Mutex{}
+	parsers     = make(map[string]Parser)
+)
+
+// RegisterParser makes a parser available to SelectParsers. It
+// panics if a parser with the same name is already registered.
+func RegisterParser(p Parser) {
+	parserMutex.Lock()
+	defer parserMutex.Unlock()
+
+	if _, exists := parsers[p.Name()]; exists {
+		panic("Parser registered twice: " + p.Name())
+	}
+
+	parsers[p.Name()] = p
+}
+
+// SelectParsers returns the registered parsers with the given names
+// in the order they should run in.
+func SelectParsers(names []string) ([]Parser, error) {
+	parserMutex.Lock()
+	defer parserMutex.Unlock()
+
+	selected := []Parser{}
+	seen := make(map[string]bool)
+
+	for _, name := range names {
+		p, exists := parsers[name]
+		if !exists {
+			return nil, errors.New("Unknown parser: " + name)
+		}
+
+		if seen[name] {
+			continue
+		}
+
+		seen[name] = true
+		selected = append(selected, p)
+	}
+
+	sort.Stable(byOrder(selected))
+
+	return selected, nil
+}
+
+// ReportSections returns the union of all report sections needed
+// by the given parsers.
+func ReportSections(ps []Parser) []string {
+	sections := []string{}
+	seen := make(map[string]bool)
+
+	for _, p := range ps {
+		for _, s := range p.Sections() {
+			if !seen[s] {
+				seen[s] = true
+				sections = append(sections, s)
+			}
+		}
+	}
+
+	return sections
+}
+
+// RunParsers runs all parsers on the report one after another and
+// sends the results of each parser to crits right after it ran.
+// Parsers are skipped if none of their sections is in the report.
+// A failing parser is logged and the others still run, but its
+// results are not sent and the run returns an error afterwards, so
+// the message is retried. The results of a partial run may differ
+// from the ones of a retry and couldn't be told apart in crits.
+// A FatalError or a failure to add the results to crits stops the
+// run right away. Failures of parsers are returned as ParserError.
+//
+// Results which were sent before (according to the ledger) are not
+// sent again. The parsers still run, so later parsers can use their
+// results, but have to check the ledger before causing side effects.
+func RunParsers(ps []Parser, report *CkoTasksReport, ctx *ParserContext) ([]*CrtResult, error) {
+	var failure error
+
+	for _, p := range ps {
+		sections := p.Sections()
+		if missing := report.missingSections(sections); len(sections) > 0 && len(missing) == len(sections) {
+			ctx.C.Info.Printf("Skipping parser %s, report lacks %v [%s]\n", p.Name(), missing, ctx.Crits.Data.AnalysisId)
+			continue
+		}
+
+		start := time.Now()
+		span := ctx.C.StartSpan("parser " + p.Name())
+		res, err := runParser(p, report, ctx)
+		span.Attrs["results"] = strconv.Itoa(len(res))
+		span.End(err)
+		elapsed := time.Since(start)
+
+		ctx.Results = append(ctx.Results, res...)
+
+		if err != nil {
+			if _, fatal := err.(*FatalError); fatal {
+				return ctx.Results, &ParserError{p.Name(), err, true}
+			}
+
+			ctx.C.Warning.Printf("Parser %s failed after %d results in %s: %s [%s]\n", p.Name(), len(res), elapsed, err, ctx.Crits.Data.AnalysisId)
+			if failure == nil {
+				failure = &ParserError{p.Name(), err, false}
+			}
+			continue
+		}
+
+		ctx.C.Debug.Printf("Parser %s returned %d results in %s [%s]\n", p.Name(), len(res), elapsed, ctx.Crits.Data.AnalysisId)
+
+		step := "results/" + p.Name()
+		if _, done := ctx.Done(step); done {
+			ctx.C.Info.Printf("Results of parser %s were already added [%s]\n", p.Name(), ctx.Crits.Data.AnalysisId)
+			continue
+		}
+
+		if err = ctx.Crits.AddResults(res, ctx.StepKey(step+"/chunks")); err != nil {
+			return ctx.Results, fmt.Errorf("adding results of parser %s: %s", p.Name(), err)
+		}
+
+		ctx.MarkDone(step, strconv.Itoa(len(res)))
+	}
+
+	return ctx.Results, failure
+}
+
+// runParser calls p.Parse and turns a panic into a normal error so
+// one broken parser can't take the whole service down.
+func runParser(p Parser, report *CkoTasksReport, ctx *ParserContext) (res []*CrtResult, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+
+	return p.Parse(report, ctx)
+}
+
+func parserOrder(p Parser) int {
+	if o, ok := p.(OrderedParser); ok {
+		return o.Order()
+	}
+
+	return 0
+}
+
+type byOrder []Parser
+
+func (s byOrder) Len() int           { return len(s) }
+func (s byOrder) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byOrder) Less(i, j int) bool { return parserOrder(s[i]) < parserOrder(s[j]) }
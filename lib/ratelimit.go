@@ -0,0 +1,152 @@
+package lib
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimitConfig limits the requests sent to a single crits
+// instance. Zero values are replaced by the defaults, negative
+// values disable the limit.
+type RateLimitConfig struct {
+	RequestsPerSecond float64 // sustained request rate (default 5)
+	Burst             int     // requests which may be sent at once after a pause (default 5)
+	Concurrency       int     // requests in flight at the same time (default 4)
+}
+
+// RateLimiter is a token bucket combined with a limit of concurrent
+// requests. All methods can be called on a nil RateLimiter, which
+// doesn't limit anything.
+type RateLimiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mutex  *sync.Mutex
+	slots  chan struct{}
+}
+
+func (c *Core) defaultRateLimitConfig() *RateLimitConfig {
+	return &RateLimitConfig{
+		RequestsPerSecond: 5,
+		Burst:             5,
+		Concurrency:       4,
+	}
+}
+
+// SetupRateLimit replaces the defaults of the crits rate limit with
+// the values set in conf. It has to be called before the first
+// CritsConn is created. A nil conf keeps the defaults.
+func (c *Core) SetupRateLimit(conf *RateLimitConfig) {
+	if conf == nil {
+		return
+	}
+
+	d := c.limiterConf
+	if conf.RequestsPerSecond != 0 {
+		d.RequestsPerSecond = conf.RequestsPerSecond
+	}
+	if conf.Burst != 0 {
+		d.Burst = conf.Burst
+	}
+	if conf.Concurrency != 0 {
+		d.Concurrency = conf.Concurrency
+	}
+}
+
+// RateLimiter returns the limiter of the given crits URL. The same
+// limiter is shared by all goroutines talking to that URL.
+func (c *Core) RateLimiter(URL string) *RateLimiter {
+	c.limiterMutex.Lock()
+	defer c.limiterMutex.Unlock()
+
+	URL = strings.TrimRight(URL, "/")
+
+	l, exists := c.limiters[URL]
+	if !exists {
+		l = newRateLimiter(c.limiterConf)
+		c.limiters[URL] = l
+	}
+
+	return l
+}
+
+// CritsURLs returns the URLs of all crits instances contacted
+// so far.
+func (c *Core) CritsURLs() []string {
+	c.limiterMutex.Lock()
+	defer c.limiterMutex.Unlock()
+
+	urls := []string{}
+	for URL := range c.limiters {
+		urls = append(urls, URL)
+	}
+	sort.Strings(urls)
+
+	return urls
+}
+
+func newRateLimiter(conf *RateLimitConfig) *RateLimiter {
+	l := &RateLimiter{
+		rate:  conf.RequestsPerSecond,
+		burst: float64(conf.Burst),
+		last:  time.Now(),
+		mutex: &sync.Mutex{},
+	}
+
+	if l.burst < 1 {
+		l.burst = 1
+	}
+	l.tokens = l.burst
+
+	if conf.Concurrency > 0 {
+		l.slots = make(chan struct{}, conf.Concurrency)
+	}
+
+	return l
+}
+
+// Acquire blocks until a request may be sent and returns the
+// function which has to be called once the request is done.
+func (l *RateLimiter) Acquire() func() {
+	if l == nil {
+		return func() {}
+	}
+
+	if l.slots != nil {
+		l.slots <- struct{}{}
+	}
+
+	if l.rate > 0 {
+		time.Sleep(l.reserve())
+	}
+
+	return func() {
+		if l.slots != nil {
+			<-l.slots
+		}
+	}
+}
+
+// reserve takes a token from the bucket and returns how long to
+// wait until the token is actually available.
+func (l *RateLimiter) reserve() time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	l.tokens -= 1
+	if l.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"regexp"
+)
+
+// redacted replaces secrets removed by Redact.
+const redacted = "[redacted]"
+
+// redactions match secrets in json, query strings, authorization
+// headers, and URLs. Backslashes cover json escaped in a string,
+// like the original message in a FailedMsg.
+var redactions = []struct {
+	re   *regexp.Regexp
+	repl string
+}{
+	{regexp.MustCompile(`(?i)(\\*"(?:api_key|apikey|password|secret)\\*"\s*:\s*\\*")[^"\\]*`), "${1}" + redacted},
+	{regexp.MustCompile(`(?i)((?:api_key|apikey|password|secret)=)[^&\s"\\]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(ApiKey )[^\s:"]+:[^\s"\\]+`), "${1}" + redacted},
+	{regexp.MustCompile(`(://[^/:@\s"]+:)[^@/\s"]+@`), "${1}" + redacted + "@"},
+}
+
+// Redact removes api keys and passwords from s, e.g. before it is
+// logged or written to a dump.
+func Redact(s string) string {
+	for _, r := range redactions {
+		s = r.re.ReplaceAllString(s, r.repl)
+	}
+
+	return s
+}
@@ -0,0 +1,300 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// CkoReportOpts controls which parts of a report are decoded by
+// TaskReport. Everything not asked for is skipped token by token
+// and never materialised.
+type CkoReportOpts struct {
+	// Sections lists the report sections to decode. Top level keys
+	// like "info" select the whole section, "behavior.calls" has to
+	// be requested explicitly to get the API calls of the processes.
+	// An empty list decodes every known section including calls.
+	Sections []string
+
+	// MaxCalls is the maximum number of API calls decoded over all
+	// processes. A negative value decodes all calls.
+	MaxCalls int
+}
+
+// section returns a pointer to the field of the report the given
+// (sub)section is decoded into or nil if the section is unknown.
+func (r *CkoTasksReport) section(name string) interface{} {
+	switch strings.SplitN(name, ".", 2)[0] {
+	case "info":
+		return &r.Info
+	case "target":
+		return &r.Target
+	case "signatures":
+		return &r.Signatures
+	case "behavior":
+		return &r.Behavior
+	case "network":
+		return &r.Network
+	case "dropped":
+		return &r.Dropped
+	}
+
+	return nil
+}
+
+// missingSections returns all of the given sections which are
+// not present in the report.
+func (r *CkoTasksReport) missingSections(sections []string) []string {
+	missing := []string{}
+
+	for _, s := range sections {
+		field := r.section(s)
+		if field == nil || reflect.ValueOf(field).Elem().IsNil() {
+			missing = append(missing, s)
+		}
+	}
+
+	return missing
+}
+
+// reportDecoder walks a cuckoo report using the token interface
+// of json.Decoder so only the wanted sections end up in memory.
+type reportDecoder struct {
+	dec       *json.Decoder
+	sections  map[string]bool
+	all       bool
+	callsLeft int
+}
+
+func decodeReport(r io.Reader, opts *CkoReportOpts) (*CkoTasksReport, error) {
+	if opts == nil {
+		opts = &CkoReportOpts{MaxCalls: -1}
+	}
+
+	rd := &reportDecoder{
+		dec:       json.NewDecoder(r),
+		sections:  make(map[string]bool),
+		all:       len(opts.Sections) == 0,
+		callsLeft: opts.MaxCalls,
+	}
+
+	for _, s := range opts.Sections {
+		rd.sections[s] = true
+		rd.sections[strings.SplitN(s, ".", 2)[0]] = true
+	}
+
+	report := &CkoTasksReport{}
+	_, err := rd.object(func(key string) error {
+		if !rd.wants(key) {
+			return rd.skip()
+		}
+
+		if key == "behavior" {
+			var err error
+			report.Behavior, err = rd.behavior()
+			return err
+		}
+
+		if field := report.section(key); field != nil {
+			return rd.dec.Decode(field)
+		}
+
+		return rd.skip()
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func (rd *reportDecoder) wants(section string) bool {
+	return rd.all || rd.sections[section]
+}
+
+// behavior decodes the behavior section. Processes are decoded one
+// by one, their calls only as long as the MaxCalls budget lasts.
+func (rd *reportDecoder) behavior() (*CkoTasksReportBehavior, error) {
+	b := &CkoTasksReportBehavior{}
+	present, err := rd.object(func(key string) error {
+		switch key {
+		case "processes":
+			return rd.array(func() error {
+				p, err := rd.process()
+				if err != nil {
+					return err
+				}
+
+				b.Processes = append(b.Processes, p)
+				return nil
+			})
+		case "summary":
+			return rd.dec.Decode(&b.Summary)
+		}
+
+		return rd.skip()
+	})
+
+	if !present {
+		return nil, err
+	}
+
+	return b, err
+}
+
+func (rd *reportDecoder) process() (*CkoTasksReportBhvPcs, error) {
+	p := &CkoTasksReportBhvPcs{}
+
+	// everything except the calls is small, so we collect the raw
+	// values and unmarshal them into the struct in one go.
+	rest := make(map[string]json.RawMessage)
+
+	_, err := rd.object(func(key string) error {
+		if key != "calls" {
+			var raw json.RawMessage
+			if err := rd.dec.Decode(&raw); err != nil {
+				return err
+			}
+
+			rest[key] = raw
+			return nil
+		}
+
+		if !rd.wants("behavior.calls") {
+			return rd.skip()
+		}
+
+		return rd.array(func() error {
+			if rd.callsLeft == 0 {
+				return rd.skip()
+			}
+
+			call := &CkoTasksReportBhvPcsCall{}
+			if err := rd.dec.Decode(call); err != nil {
+				return err
+			}
+
+			p.Calls = append(p.Calls, call)
+			if rd.callsLeft > 0 {
+				rd.callsLeft -= 1
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	restJson, err := json.Marshal(rest)
+	if err != nil {
+		return nil, err
+	}
+
+	return p, json.Unmarshal(restJson, p)
+}
+
+// object iterates over the keys of the next JSON object and calls
+// fn for each of them. fn has to consume the value of the key. If
+// the value is null instead of an object false is returned.
+func (rd *reportDecoder) object(fn func(key string) error) (bool, error) {
+	if null, err := rd.begin('{'); null || err != nil {
+		return false, err
+	}
+
+	for rd.dec.More() {
+		t, err := rd.dec.Token()
+		if err != nil {
+			return true, err
+		}
+
+		key, ok := t.(string)
+		if !ok {
+			return true, errors.New(fmt.Sprintf("expected object key in report, got %v", t))
+		}
+
+		if err = fn(key); err != nil {
+			return true, err
+		}
+	}
+
+	return true, rd.end('}')
+}
+
+// array calls fn for every element of the next JSON array. fn has
+// to consume the element. A null value is treated as empty array.
+func (rd *reportDecoder) array(fn func() error) error {
+	if null, err := rd.begin('['); null || err != nil {
+		return err
+	}
+
+	for rd.dec.More() {
+		if err := fn(); err != nil {
+			return err
+		}
+	}
+
+	return rd.end(']')
+}
+
+// skip consumes the next value without keeping any of it.
+func (rd *reportDecoder) skip() error {
+	depth := 0
+
+	for {
+		t, err := rd.dec.Token()
+		if err != nil {
+			return err
+		}
+
+		if d, ok := t.(json.Delim); ok {
+			switch d {
+			case '{', '[':
+				depth += 1
+			case '}', ']':
+				depth -= 1
+			}
+		}
+
+		if depth == 0 {
+			return nil
+		}
+	}
+}
+
+// begin consumes the opening delimiter of the next object or array.
+// It returns true if the value is null instead.
+func (rd *reportDecoder) begin(expected json.Delim) (bool, error) {
+	t, err := rd.dec.Token()
+	if err != nil {
+		return false, err
+	}
+
+	if t == nil {
+		return true, nil
+	}
+
+	if d, ok := t.(json.Delim); !ok || d != expected {
+		return false, errors.New(fmt.Sprintf("expected %s in report, got %v", expected, t))
+	}
+
+	return false, nil
+}
+
+// end consumes the closing delimiter of an object or array.
+func (rd *reportDecoder) end(expected json.Delim) error {
+	t, err := rd.dec.Token()
+	if err != nil {
+		return err
+	}
+
+	if d, ok := t.(json.Delim); !ok || d != expected {
+		return errors.New(fmt.Sprintf("expected %s in report, got %v", expected, t))
+	}
+
+	return nil
+}
@@ -0,0 +1,204 @@
+package lib
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testReport = `{
+	"info": {"started": "2017-07-14 10:00:00", "ended": "2017-07-14 10:05:00", "id": 42, "machine": {"name": "win7"}},
+	"target": {"category": "file", "file": {"name": "sample.exe", "size": 1024, "type": "PE32 executable", "md5": "abc", "yara": [{"name": "upx", "meta": {"author": "me"}}]}},
+	"debug": {"log": ["a", "b", {"nested": [1, 2, 3]}]},
+	"signatures": [
+		{"severity": 2, "description": "Creates a mutex", "name": "mutex", "families": ["zeus"], "marks": [{"mutex": "x"}], "ttp": ["T1055"]},
+		{"severity": 1, "description": "Old style", "name": "old", "data": [{"file": "y"}]}
+	],
+	"behavior": {
+		"generic": [{"pid": 1}],
+		"processes": [
+			{"process_name": "sample.exe", "process_id": 1, "parent_id": 0, "first_seen": "1", "modules": [{"name": "ntdll"}],
+			 "calls": [
+				{"category": "file", "status": true, "api": "NtCreateFile", "arguments": [{"name": "FileName", "value": "a.txt"}], "id": 0},
+				{"category": "registry", "status": false, "api": "RegOpenKeyExW", "id": 1}
+			 ]},
+			{"calls": [
+				{"category": "process", "api": "NtCreateProcess", "id": 0},
+				{"category": "process", "api": "NtTerminateProcess", "id": 1}
+			 ], "process_name": "child.exe", "process_id": 2, "parent_id": 1, "first_seen": "2"}
+		],
+		"summary": {"files": ["a.txt"], "keys": ["HKCU\\Run"], "mutexes": ["x"]}
+	},
+	"network": {"hosts": ["10.0.0.1", {"ip": "8.8.8.8"}], "domains": [{"domain": "evil.com", "ip": "1.2.3.4"}], "http": [{"uri": "/a", "host": "evil.com", "method": "GET"}]},
+	"static": {"pe_imports": [{"dll": "kernel32.dll"}]},
+	"dropped": [{"name": "a.txt", "size": 3, "type": "ASCII text", "md5": "def"}]
+}`
+
+func decodeTestReport(t *testing.T, report string, opts *CkoReportOpts) *CkoTasksReport {
+	r, err := decodeReport(strings.NewReader(report), opts)
+	if err != nil {
+		t.Fatalf("decodeReport(%+v) failed: %s", opts, err)
+	}
+
+	return r
+}
+
+func countCalls(r *CkoTasksReport) []int {
+	calls := []int{}
+	if r.Behavior == nil {
+		return calls
+	}
+
+	for _, p := range r.Behavior.Processes {
+		calls = append(calls, len(p.Calls))
+	}
+
+	return calls
+}
+
+// The streaming decoder has to produce the same report as the full
+// unmarshal it replaced if everything is asked for.
+func TestDecodeReportMatchesUnmarshal(t *testing.T) {
+	want := &CkoTasksReport{}
+	if err := json.Unmarshal([]byte(testReport), want); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []*CkoReportOpts{nil, {MaxCalls: -1}} {
+		got := decodeTestReport(t, testReport, opts)
+		if !reflect.DeepEqual(got, want) {
+			gotJson, _ := json.Marshal(got)
+			wantJson, _ := json.Marshal(want)
+			t.Errorf("decodeReport(%+v) = %s, want %s", opts, gotJson, wantJson)
+		}
+	}
+}
+
+func TestDecodeReportSections(t *testing.T) {
+	tests := []struct {
+		opts    *CkoReportOpts
+		present []string
+		calls   []int
+	}{
+		{&CkoReportOpts{Sections: []string{"dropped"}}, []string{"dropped"}, []int{}},
+		{&CkoReportOpts{Sections: []string{"info", "network"}}, []string{"info", "network"}, []int{}},
+		{&CkoReportOpts{Sections: []string{"signatures", "target"}}, []string{"signatures", "target"}, []int{}},
+
+		// calls have to be asked for explicitly
+		{&CkoReportOpts{Sections: []string{"behavior"}, MaxCalls: -1}, []string{"behavior"}, []int{0, 0}},
+		{&CkoReportOpts{Sections: []string{"behavior.calls"}, MaxCalls: -1}, []string{"behavior"}, []int{2, 2}},
+
+		// MaxCalls is a budget over all processes
+		{&CkoReportOpts{Sections: []string{"behavior.calls"}, MaxCalls: 3}, []string{"behavior"}, []int{2, 1}},
+		{&CkoReportOpts{Sections: []string{"behavior.calls"}, MaxCalls: 1}, []string{"behavior"}, []int{1, 0}},
+		{&CkoReportOpts{Sections: []string{"behavior.calls"}, MaxCalls: 0}, []string{"behavior"}, []int{0, 0}},
+		{&CkoReportOpts{MaxCalls: 2}, []string{"info", "target", "signatures", "behavior", "network", "dropped"}, []int{2, 0}},
+
+		// unknown sections are skipped like the unrequested ones
+		{&CkoReportOpts{Sections: []string{"static", "debug"}}, []string{}, []int{}},
+	}
+
+	all := []string{"info", "target", "signatures", "behavior", "network", "dropped"}
+
+	for _, tt := range tests {
+		r := decodeTestReport(t, testReport, tt.opts)
+
+		wantMissing := []string{}
+		for _, s := range all {
+			found := false
+			for _, p := range tt.present {
+				found = found || p == s
+			}
+			if !found {
+				wantMissing = append(wantMissing, s)
+			}
+		}
+
+		if missing := r.missingSections(all); !reflect.DeepEqual(missing, wantMissing) {
+			t.Errorf("decodeReport(%+v) lacks %v, want %v", tt.opts, missing, wantMissing)
+		}
+
+		if calls := countCalls(r); !reflect.DeepEqual(calls, tt.calls) {
+			t.Errorf("decodeReport(%+v) has calls %v per process, want %v", tt.opts, calls, tt.calls)
+		}
+	}
+}
+
+func TestDecodeReportNull(t *testing.T) {
+	tests := []struct {
+		report  string
+		missing []string
+	}{
+		{`{"info": null, "target": null, "signatures": null, "behavior": null, "network": null, "dropped": null}`,
+			[]string{"info", "target", "signatures", "behavior", "network", "dropped"}},
+		{`{"behavior": {"processes": null, "summary": null}}`, []string{"info", "target", "signatures", "network", "dropped"}},
+		{`{"behavior": {"processes": [{"process_name": "a.exe", "calls": null}]}}`, []string{"info", "target", "signatures", "network", "dropped"}},
+		{`{}`, []string{"info", "target", "signatures", "behavior", "network", "dropped"}},
+	}
+
+	all := []string{"info", "target", "signatures", "behavior", "network", "dropped"}
+
+	for _, tt := range tests {
+		want := &CkoTasksReport{}
+		if err := json.Unmarshal([]byte(tt.report), want); err != nil {
+			t.Fatal(err)
+		}
+
+		r := decodeTestReport(t, tt.report, &CkoReportOpts{MaxCalls: -1})
+		if !reflect.DeepEqual(r, want) {
+			t.Errorf("decodeReport(%s) differs from json.Unmarshal", tt.report)
+		}
+
+		if missing := r.missingSections(all); !reflect.DeepEqual(missing, tt.missing) {
+			t.Errorf("decodeReport(%s) lacks %v, want %v", tt.report, missing, tt.missing)
+		}
+	}
+}
+
+// Everything of a process except the calls is collected as raw
+// values, the order of the keys mustn't matter.
+func TestDecodeReportProcess(t *testing.T) {
+	r := decodeTestReport(t, testReport, &CkoReportOpts{Sections: []string{"behavior.calls"}, MaxCalls: -1})
+
+	want := []CkoTasksReportBhvPcs{
+		{Name: "sample.exe", Id: 1, ParentId: 0, FirstSeen: "1"},
+		{Name: "child.exe", Id: 2, ParentId: 1, FirstSeen: "2"},
+	}
+
+	if len(r.Behavior.Processes) != len(want) {
+		t.Fatalf("decoded %d processes, want %d", len(r.Behavior.Processes), len(want))
+	}
+
+	for i, p := range r.Behavior.Processes {
+		got := *p
+		got.Calls = nil
+		if !reflect.DeepEqual(got, want[i]) {
+			t.Errorf("process %d = %+v, want %+v", i, got, want[i])
+		}
+	}
+
+	call := r.Behavior.Processes[0].Calls[0]
+	if call.Api != "NtCreateFile" || len(call.Arguments) != 1 || call.Arguments[0].Value != "a.txt" {
+		t.Errorf("first call = %+v", call)
+	}
+
+	if r.Behavior.Summary == nil || len(r.Behavior.Summary.Mutexes) != 1 {
+		t.Errorf("summary = %+v", r.Behavior.Summary)
+	}
+}
+
+func TestDecodeReportInvalid(t *testing.T) {
+	for _, report := range []string{
+		``,
+		`[]`,
+		`{"info": {"id": 1}`,
+		`{"behavior": {"processes": {}}}`,
+		`{"behavior": {"processes": [{"calls": [{"api": 1}]}]}}`,
+		`{"signatures": [1, 2]}`,
+	} {
+		if _, err := decodeReport(strings.NewReader(report), &CkoReportOpts{MaxCalls: -1}); err == nil {
+			t.Errorf("decodeReport(%s) succeeded", report)
+		}
+	}
+}
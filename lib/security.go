@@ -0,0 +1,188 @@
+package lib
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/streadway/amqp"
+)
+
+// SecurityConfig configures the signing and encryption of the
+// messages. Keys are base64 encoded and referenced by an id, so new
+// keys can be rolled out before the old ones are removed.
+type SecurityConfig struct {
+	SigningKeys    map[string]string // HMAC-SHA256 keys by id, every key is accepted
+	SigningKey     string            // id of the key used to sign sent messages
+	EncryptionKeys map[string]string // AES keys (16, 24, or 32 bytes) by id, every key is accepted
+	EncryptionKey  string            // id of the key used to encrypt sent messages, empty to send them in plain text
+}
+
+// Headers of signed and encrypted messages.
+const (
+	signatureHeader    = "x-signature"
+	signatureKeyHeader = "x-signature-key"
+	encryptionHeader   = "x-encryption-key"
+)
+
+type security struct {
+	signingKeys   map[string][]byte
+	signingKey    string
+	ciphers       map[string]cipher.AEAD
+	encryptionKey string
+}
+
+// SetupSecurity loads the keys set in conf. Once signing keys are
+// set, every sent message is signed and every received message has
+// to carry a valid signature. Without keys, messages are neither
+// signed nor verified.
+func (c *Core) SetupSecurity(conf *SecurityConfig) {
+	if conf == nil || len(conf.SigningKeys) == 0 {
+		c.Warning.Println("No signing keys set, messages are neither signed nor verified!")
+		return
+	}
+
+	s := &security{
+		signingKeys:   make(map[string][]byte),
+		signingKey:    conf.SigningKey,
+		ciphers:       make(map[string]cipher.AEAD),
+		encryptionKey: conf.EncryptionKey,
+	}
+
+	for id, k := range conf.SigningKeys {
+		key, err := base64.StdEncoding.DecodeString(k)
+		c.FailOnError(err, "Couldn't decode signing key "+id)
+		if len(key) < 32 {
+			c.FailOnError(errors.New("key is shorter than 32 bytes"), "Signing key "+id+" is too weak!")
+		}
+
+		s.signingKeys[id] = key
+	}
+
+	if _, exists := s.signingKeys[s.signingKey]; !exists {
+		c.FailOnError(errors.New(fmt.Sprintf("unknown key %q", s.signingKey)), "Invalid SigningKey!")
+	}
+
+	for id, k := range conf.EncryptionKeys {
+		key, err := base64.StdEncoding.DecodeString(k)
+		c.FailOnError(err, "Couldn't decode encryption key "+id)
+
+		block, err := aes.NewCipher(key)
+		c.FailOnError(err, "Invalid encryption key "+id)
+
+		aead, err := cipher.NewGCM(block)
+		c.FailOnError(err, "Invalid encryption key "+id)
+
+		s.ciphers[id] = aead
+	}
+
+	if _, exists := s.ciphers[s.encryptionKey]; s.encryptionKey != "" && !exists {
+		c.FailOnError(errors.New(fmt.Sprintf("unknown key %q", s.encryptionKey)), "Invalid EncryptionKey!")
+	}
+
+	c.security = s
+
+	if s.encryptionKey != "" {
+		c.Info.Printf("Signing messages with key %s, encrypting with key %s\n", s.signingKey, s.encryptionKey)
+	} else {
+		c.Info.Printf("Signing messages with key %s\n", s.signingKey)
+	}
+}
+
+// signature is the HMAC of a message. The routing key is included,
+// so a message can't be replayed to another queue.
+func signature(key []byte, routingKey string, body []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(routingKey + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// seal encrypts and signs a message which is sent to routingKey.
+// The headers are added to headers.
+func (s *security) seal(routingKey string, body []byte, headers amqp.Table) ([]byte, error) {
+	if s == nil {
+		return body, nil
+	}
+
+	if s.encryptionKey != "" {
+		aead := s.ciphers[s.encryptionKey]
+
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return nil, err
+		}
+
+		body = aead.Seal(nonce, nonce, body, []byte(routingKey))
+		headers[encryptionHeader] = s.encryptionKey
+	}
+
+	headers[signatureKeyHeader] = s.signingKey
+	headers[signatureHeader] = base64.StdEncoding.EncodeToString(signature(s.signingKeys[s.signingKey], routingKey, body))
+
+	return body, nil
+}
+
+// open verifies the signature of msg and decrypts the body in place.
+func (s *security) open(msg *amqp.Delivery) error {
+	if s == nil {
+		return nil
+	}
+
+	id, _ := msg.Headers[signatureKeyHeader].(string)
+	sig, _ := msg.Headers[signatureHeader].(string)
+	if id == "" || sig == "" {
+		return errors.New("message is not signed")
+	}
+
+	key, exists := s.signingKeys[id]
+	if !exists {
+		return errors.New(fmt.Sprintf("message is signed with unknown key %q", id))
+	}
+
+	mac, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, signature(key, msg.RoutingKey, msg.Body)) {
+		return errors.New("invalid signature")
+	}
+
+	id, encrypted := msg.Headers[encryptionHeader].(string)
+	if !encrypted {
+		return nil
+	}
+
+	aead, exists := s.ciphers[id]
+	if !exists {
+		return errors.New(fmt.Sprintf("message is encrypted with unknown key %q", id))
+	}
+
+	if len(msg.Body) < aead.NonceSize() {
+		return errors.New("encrypted message is too short")
+	}
+
+	nonce, ciphertext := msg.Body[:aead.NonceSize()], msg.Body[aead.NonceSize():]
+	body, err := aead.Open(nil, nonce, ciphertext, []byte(msg.RoutingKey))
+	if err != nil {
+		return errors.New("decrypting the message failed: " + err.Error())
+	}
+
+	msg.Body = body
+	return nil
+}
+
+// reject drops a message which failed the verification. It is not
+// sent to the overseer, which would resubmit it with a valid
+// signature.
+func (c *Core) reject(msg *amqp.Delivery, err error) {
+	c.Warning.Println("[REJECT] Dropping message which failed the verification:", err)
+
+	if err := msg.Nack(false, false); err != nil {
+		c.Warning.Println("Sending NACK failed!", err.Error())
+	}
+
+	c.metrics.rejected.Inc(msg.RoutingKey)
+}
@@ -0,0 +1,131 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func testSecurity(t *testing.T, encrypt bool) *security {
+	s := &security{
+		signingKeys: map[string][]byte{
+			"old": bytes.Repeat([]byte{1}, 32),
+			"new": bytes.Repeat([]byte{2}, 32),
+		},
+		signingKey: "new",
+		ciphers:    make(map[string]cipher.AEAD),
+	}
+
+	if encrypt {
+		block, err := aes.NewCipher(bytes.Repeat([]byte{3}, 32))
+		if err != nil {
+			t.Fatal(err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.ciphers["k1"] = aead
+		s.encryptionKey = "k1"
+	}
+
+	return s
+}
+
+// sealed returns a delivery of body sealed for routingKey.
+func sealed(t *testing.T, s *security, routingKey string, body []byte) *amqp.Delivery {
+	headers := amqp.Table{}
+	sealedBody, err := s.seal(routingKey, body, headers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &amqp.Delivery{RoutingKey: routingKey, Headers: headers, Body: sealedBody}
+}
+
+func TestSealOpen(t *testing.T) {
+	body := []byte(`{"type":"check_results_req","payload":{}}`)
+
+	for _, encrypt := range []bool{false, true} {
+		s := testSecurity(t, encrypt)
+		msg := sealed(t, s, "worker/check_results", body)
+
+		if encrypt == bytes.Equal(msg.Body, body) {
+			t.Errorf("encrypt=%v: sealed body is %q", encrypt, msg.Body)
+		}
+
+		if err := s.open(msg); err != nil {
+			t.Fatalf("encrypt=%v: open failed: %s", encrypt, err)
+		}
+		if !bytes.Equal(msg.Body, body) {
+			t.Errorf("encrypt=%v: opened body is %q, want %q", encrypt, msg.Body, body)
+		}
+	}
+}
+
+func TestOpenRejects(t *testing.T) {
+	body := []byte(`{"type":"check_results_req","payload":{}}`)
+
+	tests := []struct {
+		name    string
+		encrypt bool
+		tamper  func(msg *amqp.Delivery)
+	}{
+		{"wrong routing key", false, func(msg *amqp.Delivery) {
+			msg.RoutingKey = "worker/parse_and_submit"
+		}},
+		{"wrong routing key encrypted", true, func(msg *amqp.Delivery) {
+			msg.RoutingKey = "worker/parse_and_submit"
+		}},
+		{"tampered body", false, func(msg *amqp.Delivery) {
+			msg.Body[len(msg.Body)-2] ^= 1
+		}},
+		{"tampered ciphertext", true, func(msg *amqp.Delivery) {
+			msg.Body[len(msg.Body)-1] ^= 1
+		}},
+		{"unknown signing key", false, func(msg *amqp.Delivery) {
+			msg.Headers[signatureKeyHeader] = "unknown"
+		}},
+		{"signed with another known key", false, func(msg *amqp.Delivery) {
+			msg.Headers[signatureKeyHeader] = "old"
+		}},
+		{"unknown encryption key", true, func(msg *amqp.Delivery) {
+			msg.Headers[encryptionHeader] = "unknown"
+		}},
+		{"missing signature", false, func(msg *amqp.Delivery) {
+			delete(msg.Headers, signatureHeader)
+		}},
+		{"missing signature key", false, func(msg *amqp.Delivery) {
+			delete(msg.Headers, signatureKeyHeader)
+		}},
+		{"invalid signature encoding", false, func(msg *amqp.Delivery) {
+			msg.Headers[signatureHeader] = "not base64!"
+		}},
+		{"no headers", false, func(msg *amqp.Delivery) {
+			msg.Headers = nil
+		}},
+	}
+
+	for _, tt := range tests {
+		s := testSecurity(t, tt.encrypt)
+		msg := sealed(t, s, "worker/check_results", body)
+		tt.tamper(msg)
+
+		if err := s.open(msg); err == nil {
+			t.Errorf("%s: open succeeded", tt.name)
+		}
+	}
+}
+
+func TestOpenWithoutKeys(t *testing.T) {
+	var s *security
+	msg := &amqp.Delivery{RoutingKey: "worker/feed_cuckoo", Body: []byte("plain")}
+
+	if err := s.open(msg); err != nil || string(msg.Body) != "plain" {
+		t.Errorf("open without keys = %v, body %q", err, msg.Body)
+	}
+}
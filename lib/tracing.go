@@ -0,0 +1,331 @@
+package lib
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// TraceConfig configures where finished spans are exported to.
+// Trace context is always propagated, even without an exporter.
+type TraceConfig struct {
+	Exporter string // "otlp", "file", or empty to export nothing
+	Endpoint string // OTLP/HTTP traces endpoint, e.g. http://collector:4318/v1/traces
+	File     string // file the spans are appended to, one OTLP JSON request per line
+}
+
+// traceHeader is the W3C trace context header used in amqp
+// messages and http requests.
+const traceHeader = "traceparent"
+
+// Spans are exported in batches of at most traceBatchSize spans
+// or every traceFlushInterval.
+const (
+	traceBatchSize     = 100
+	traceFlushInterval = time.Second * 5
+)
+
+// Span is a timed operation within a trace, like handling a
+// message or a single http request.
+type Span struct {
+	TraceId  string
+	SpanId   string
+	ParentId string
+	Name     string
+	Kind     int // OTLP span kind: 1 internal, 2 server, 3 client, 4 producer, 5 consumer
+	Start    time.Time
+	Finish   time.Time
+	Attrs    map[string]string
+	Err      string
+
+	tracer *tracer
+	once   *sync.Once
+}
+
+type tracer struct {
+	service string
+	conf    *TraceConfig
+	client  *http.Client
+	spans   chan *Span
+	warning func(v ...interface{})
+}
+
+func (c *Core) setupTracing() {
+	c.tracer = &tracer{service: c.ServiceName}
+}
+
+// SetupTracing starts exporting spans as configured in conf. A nil
+// conf or empty exporter only propagates the trace context.
+func (c *Core) SetupTracing(conf *TraceConfig) {
+	if conf == nil || conf.Exporter == "" {
+		return
+	}
+
+	switch conf.Exporter {
+	case "otlp":
+		if conf.Endpoint == "" {
+			c.FailOnError(errors.New("no Endpoint set"), "Couldn't set up tracing!")
+		}
+	case "file":
+		f, err := os.OpenFile(conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, logFileMode)
+		c.FailOnError(err, "Couldn't open the trace file!")
+		f.Close()
+	default:
+		c.FailOnError(errors.New("unknown exporter "+conf.Exporter), "Couldn't set up tracing!")
+	}
+
+	t := c.tracer
+	t.conf = conf
+	t.client = c.Client
+	t.spans = make(chan *Span, traceBatchSize*10)
+	t.warning = c.Warning.Println
+
+	c.Info.Printf("Exporting traces via %s\n", conf.Exporter)
+	go t.export()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (t *tracer) newSpan(name string, kind int, traceId, parentId string) *Span {
+	if traceId == "" {
+		traceId = randomHex(16)
+	}
+
+	return &Span{
+		TraceId:  traceId,
+		SpanId:   randomHex(8),
+		ParentId: parentId,
+		Name:     name,
+		Kind:     kind,
+		Start:    time.Now(),
+		Attrs:    make(map[string]string),
+		tracer:   t,
+		once:     &sync.Once{},
+	}
+}
+
+// StartSpan starts a span which is a child of the current span of c
+// or the root of a new trace. It has to be ended with End.
+func (c *Core) StartSpan(name string) *Span {
+	return c.startSpan(name, 1)
+}
+
+func (c *Core) startSpan(name string, kind int) *Span {
+	if c.span == nil {
+		return c.tracer.newSpan(name, kind, "", "")
+	}
+
+	return c.tracer.newSpan(name, kind, c.span.TraceId, c.span.SpanId)
+}
+
+// End finishes the span, err marks it as failed. Only the first
+// call has an effect.
+func (s *Span) End(err error) {
+	if s == nil {
+		return
+	}
+
+	s.once.Do(func() {
+		s.Finish = time.Now()
+		if err != nil {
+			s.Err = Redact(err.Error())
+		}
+
+		if s.tracer.spans == nil {
+			return
+		}
+
+		select {
+		case s.tracer.spans <- s:
+		default:
+			// the exporter can't keep up, rather lose spans
+			// than slow down the message handling
+		}
+	})
+}
+
+// Traceparent returns the W3C trace context header of the span.
+func (s *Span) Traceparent() string {
+	return fmt.Sprintf("00-%s-%s-01", s.TraceId, s.SpanId)
+}
+
+// parseTraceparent returns the trace and span id of a W3C trace
+// context header.
+func parseTraceparent(h string) (string, string, bool) {
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", "", false
+	}
+
+	if _, err := hex.DecodeString(parts[1] + parts[2]); err != nil {
+		return "", "", false
+	}
+
+	return parts[1], parts[2], true
+}
+
+// consumeSpan starts the span covering the handling of msg, the
+// trace is continued if the sender added its trace context.
+func (c *Core) consumeSpan(msg *amqp.Delivery) *Span {
+	h, ok := msg.Headers[traceHeader].(string)
+	if !ok {
+		// e.g. messages resubmitted from a dump
+		if env, err := decodeEnvelope(msg.Body, ""); err == nil {
+			h = env.Trace
+		}
+	}
+
+	traceId, parentId, _ := parseTraceparent(h)
+
+	span := c.tracer.newSpan("consume "+msg.RoutingKey, 5, traceId, parentId)
+	span.Attrs["messaging.destination"] = msg.RoutingKey
+	return span
+}
+
+// export sends the finished spans in batches.
+func (t *tracer) export() {
+	batch := []*Span{}
+	ticker := time.NewTicker(traceFlushInterval)
+
+	for {
+		select {
+		case s := <-t.spans:
+			batch = append(batch, s)
+			if len(batch) < traceBatchSize {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		if err := t.write(batch); err != nil {
+			t.warning("Exporting spans failed!", err)
+		}
+		batch = []*Span{}
+	}
+}
+
+type otlpAttr struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpSpan struct {
+	TraceId           string      `json:"traceId"`
+	SpanId            string      `json:"spanId"`
+	ParentSpanId      string      `json:"parentSpanId,omitempty"`
+	Name              string      `json:"name"`
+	Kind              int         `json:"kind"`
+	StartTimeUnixNano string      `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string      `json:"endTimeUnixNano"`
+	Attributes        []*otlpAttr `json:"attributes"`
+	Status            interface{} `json:"status"`
+}
+
+func otlpAttrs(attrs map[string]string) []*otlpAttr {
+	res := []*otlpAttr{}
+	for k, v := range attrs {
+		res = append(res, &otlpAttr{k, map[string]string{"stringValue": v}})
+	}
+
+	return res
+}
+
+// otlpRequest encodes the spans as OTLP/HTTP JSON export request.
+func (t *tracer) otlpRequest(batch []*Span) ([]byte, error) {
+	spans := []*otlpSpan{}
+	for _, s := range batch {
+		// 1: ok, 2: error
+		status := map[string]interface{}{"code": 1}
+		if s.Err != "" {
+			status = map[string]interface{}{"code": 2, "message": s.Err}
+		}
+
+		spans = append(spans, &otlpSpan{
+			TraceId:           s.TraceId,
+			SpanId:            s.SpanId,
+			ParentSpanId:      s.ParentId,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: fmt.Sprintf("%d", s.Start.UnixNano()),
+			EndTimeUnixNano:   fmt.Sprintf("%d", s.Finish.UnixNano()),
+			Attributes:        otlpAttrs(s.Attrs),
+			Status:            status,
+		})
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttrs(map[string]string{"service.name": t.service}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "cuckoo_distributed"},
+						"spans": spans,
+					},
+				},
+			},
+		},
+	})
+}
+
+// write exports a batch of spans.
+func (t *tracer) write(batch []*Span) error {
+	body, err := t.otlpRequest(batch)
+	if err != nil {
+		return err
+	}
+
+	if t.conf.Exporter == "file" {
+		f, err := os.OpenFile(t.conf.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, logFileMode)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = f.Write(append(body, '\n'))
+		return err
+	}
+
+	// the exporter doesn't go through Do, its requests shouldn't
+	// be traced themselves or trip the circuit breakers.
+	ctx, cancel := context.WithTimeout(context.Background(), traceFlushInterval)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", t.conf.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer SafeResponseClose(resp)
+
+	if resp.StatusCode != 200 {
+		return errors.New(fmt.Sprintf("%s answered %s", t.conf.Endpoint, resp.Status))
+	}
+
+	return nil
+}
@@ -0,0 +1,667 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cynexit/cuckoo_distributed/lib"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// adminConfig configures the admin server for the dead-letter store.
+type adminConfig struct {
+	Addr     string            // address to listen on, empty to disable
+	Users    map[string]string // bcrypt hash of the password by user, for basic auth
+	CertFile string            // TLS certificate, empty to serve plain HTTP on a loopback Addr
+	KeyFile  string            // TLS key
+}
+
+// recordLimit is the number of records shown on a page.
+const recordLimit = 500
+
+type admin struct {
+	users     map[string][]byte
+	unknown   []byte // hash checked for unknown users, so they take as long as known ones
+	csrfKey   []byte
+	templates *template.Template
+}
+
+// dlqGroup are the records which failed with the same error.
+type dlqGroup struct {
+	Service string    `json:"service"`
+	Code    string    `json:"code"`
+	Error   string    `json:"error"`
+	Count   int       `json:"count"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+}
+
+// ids, counters, and the like make every error unique
+var variableParts = regexp.MustCompile(`[0-9a-fA-F]{8,}|[0-9]+`)
+
+// groupOf returns the error a record is grouped by.
+func groupOf(r *dlqRecord) string {
+	e := lib.Redact(r.Error)
+	if e == "" {
+		e = r.Reason
+	}
+
+	return variableParts.ReplaceAllString(e, "#")
+}
+
+// groups groups the records by service, code and error, the largest
+// groups first.
+func groups(records []*dlqRecord) []*dlqGroup {
+	byKey := make(map[string]*dlqGroup)
+	list := []*dlqGroup{}
+
+	for _, r := range records {
+		e := groupOf(r)
+		key := r.Service + "\x00" + r.Code + "\x00" + e
+
+		g, exists := byKey[key]
+		if !exists {
+			g = &dlqGroup{Service: r.Service, Code: r.Code, Error: e, First: r.DumpedAt}
+			byKey[key] = g
+			list = append(list, g)
+		}
+
+		g.Count += 1
+		g.Last = r.DumpedAt
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		return list[i].Count > list[j].Count
+	})
+
+	return list
+}
+
+// startAdmin serves the admin UI on / and the JSON API on /api/.
+func startAdmin(conf *adminConfig) {
+	if conf == nil || conf.Addr == "" {
+		return
+	}
+
+	if len(conf.Users) == 0 {
+		c.FailOnError(errors.New("no users set"), "The admin server needs Users!")
+	}
+
+	a := &admin{
+		users:     make(map[string][]byte),
+		csrfKey:   make([]byte, 32),
+		templates: template.Must(template.New("").Funcs(templateFuncs).Parse(adminTemplates)),
+	}
+
+	if conf.CertFile == "" && !isLoopback(conf.Addr) {
+		c.FailOnError(errors.New("no CertFile set"), "The admin server needs TLS unless it listens on a loopback address!")
+	}
+
+	cost := bcrypt.MinCost
+	for user, hash := range conf.Users {
+		userCost, err := bcrypt.Cost([]byte(hash))
+		c.FailOnError(err, "Invalid password hash of admin user "+user)
+		if userCost > cost {
+			cost = userCost
+		}
+		a.users[user] = []byte(hash)
+	}
+
+	_, err := rand.Read(a.csrfKey)
+	c.FailOnError(err, "Couldn't create the CSRF key!")
+
+	a.unknown, err = bcrypt.GenerateFromPassword(a.csrfKey, cost)
+	c.FailOnError(err, "Couldn't create the password hash for unknown users!")
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", a.auth(a.serveIndex))
+	mux.HandleFunc("/records/", a.auth(a.serveRecord))
+	mux.HandleFunc("/replay", a.auth(a.serveAction))
+	mux.HandleFunc("/discard", a.auth(a.serveAction))
+	mux.HandleFunc("/api/groups", a.auth(a.apiGroups))
+	mux.HandleFunc("/api/records", a.auth(a.apiRecords))
+	mux.HandleFunc("/api/records/", a.auth(a.apiRecord))
+	mux.HandleFunc("/api/replay", a.auth(a.apiAction))
+	mux.HandleFunc("/api/discard", a.auth(a.apiAction))
+
+	listener, err := net.Listen("tcp", conf.Addr)
+	c.FailOnError(err, "Couldn't start the admin server!")
+
+	c.Info.Println("Serving the admin UI on", conf.Addr)
+
+	go func() {
+		if conf.CertFile != "" {
+			err = http.ServeTLS(listener, mux, conf.CertFile, conf.KeyFile)
+		} else {
+			err = http.Serve(listener, mux)
+		}
+		c.FailOnError(err, "Admin server failed!")
+	}()
+}
+
+// isLoopback checks if addr only accepts connections from this host.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// auth checks the basic auth credentials before calling next.
+func (a *admin) auth(next func(w http.ResponseWriter, r *http.Request, user string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Frame-Options", "DENY")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", "default-src 'none'; style-src 'unsafe-inline'; form-action 'self'")
+
+		user, password, ok := r.BasicAuth()
+		hash, exists := a.users[user]
+		if !exists {
+			hash = a.unknown
+		}
+		if err := bcrypt.CompareHashAndPassword(hash, []byte(password)); !ok || !exists || err != nil {
+			w.Header().Set("WWW-Authenticate", `Basic realm="overseer"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r, user)
+	}
+}
+
+// csrfToken is sent with every form of the UI, so other sites can't
+// make the browser of a logged in user replay or discard messages.
+func (a *admin) csrfToken(user string) string {
+	mac := hmac.New(sha256.New, a.csrfKey)
+	mac.Write([]byte(user))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// filterOf reads the filter from the query or form values.
+func filterOf(v url.Values) (*dlqFilter, error) {
+	f := &dlqFilter{
+		service:    v.Get("service"),
+		code:       v.Get("code"),
+		errText:    v.Get("error"),
+		analysisId: v.Get("analysis"),
+		ids:        make(map[string]bool),
+	}
+
+	var err error
+	if f.since, err = parseTime(v.Get("since")); err != nil {
+		return nil, err
+	}
+	if f.until, err = parseTime(v.Get("until")); err != nil {
+		return nil, err
+	}
+	for _, id := range v["id"] {
+		f.ids[id] = true
+	}
+
+	return f, nil
+}
+
+// inGroup keeps the records of the group given in the values, the
+// error of a group can't be matched by the error filter.
+func inGroup(records []*dlqRecord, v url.Values) []*dlqRecord {
+	group, grouped := v["group"]
+	if !grouped {
+		return records
+	}
+
+	matching := []*dlqRecord{}
+	for _, r := range records {
+		if groupOf(r) == group[0] {
+			matching = append(matching, r)
+		}
+	}
+
+	return matching
+}
+
+// selected returns the records matching the values.
+func selected(v url.Values) ([]*dlqRecord, error) {
+	f, err := filterOf(v)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := store.find(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return inGroup(records, v), nil
+}
+
+// decoded is a record with its msg decoded for display.
+type decoded struct {
+	*dlqRecord
+	Envelope *lib.Envelope `json:"envelope,omitempty"`
+	Payload  interface{}   `json:"payload,omitempty"`
+	Invalid  string        `json:"invalid,omitempty"` // why the msg couldn't be decoded
+}
+
+// decode decodes the msg of a record, without its secrets.
+func decode(r *dlqRecord) *decoded {
+	redacted := r.redacted()
+	d := &decoded{dlqRecord: redacted}
+
+	var payload interface{}
+	env, err := lib.OpenEnvelope([]byte(redacted.Msg), r.Type, &payload)
+	if err != nil {
+		d.Invalid = err.Error()
+		return d
+	}
+
+	env.Payload = nil
+	d.Envelope = env
+	d.Payload = payload
+	return d
+}
+
+// act replays or discards the records and returns the ids of the
+// ones which were handled and the errors of the others.
+func act(action, user string, records []*dlqRecord) ([]string, map[string]string) {
+	done := []string{}
+	failed := make(map[string]string)
+
+	for _, r := range records {
+		var err error
+		if action == "replay" {
+			err = store.replay(r)
+		} else {
+			err = store.remove(r.Id)
+		}
+
+		if err != nil {
+			failed[r.Id] = err.Error()
+			continue
+		}
+
+		c.Info.Printf("%s %s record %s (%s, %s)\n", user, action, r.Id, r.Service, r.Queue)
+		done = append(done, r.Id)
+	}
+
+	return done, failed
+}
+
+func actionOf(r *http.Request) string {
+	if strings.HasSuffix(r.URL.Path, "/replay") {
+		return "replay"
+	}
+
+	return "discard"
+}
+
+func (a *admin) serveIndex(w http.ResponseWriter, r *http.Request, user string) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	records, err := selected(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	all, err := store.all()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	total := len(records)
+	if total > recordLimit {
+		records = records[:recordLimit]
+	}
+
+	shown := []*dlqRecord{}
+	for _, rec := range records {
+		shown = append(shown, rec.redacted())
+	}
+
+	a.render(w, "index", map[string]interface{}{
+		"Groups":  groups(all),
+		"Records": shown,
+		"Total":   total,
+		"Query":   r.URL.Query(),
+		"CSRF":    a.csrfToken(user),
+	})
+}
+
+func (a *admin) serveRecord(w http.ResponseWriter, r *http.Request, user string) {
+	rec, err := store.get(strings.TrimPrefix(r.URL.Path, "/records/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	a.render(w, "record", map[string]interface{}{
+		"Record": decode(rec),
+		"CSRF":   a.csrfToken(user),
+	})
+}
+
+// serveAction replays or discards the records selected in a form of
+// the UI.
+func (a *admin) serveAction(w http.ResponseWriter, r *http.Request, user string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	r.ParseForm()
+	if !hmac.Equal([]byte(r.PostForm.Get("csrf")), []byte(a.csrfToken(user))) {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	// nothing selected must not mean everything
+	if len(r.PostForm["id"]) == 0 && r.PostForm.Get("bulk") == "" {
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	records, err := selected(r.PostForm)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	action := actionOf(r)
+	done, failed := act(action, user, records)
+
+	a.render(w, "done", map[string]interface{}{
+		"Action": action,
+		"Done":   done,
+		"Failed": failed,
+	})
+}
+
+func (a *admin) render(w http.ResponseWriter, name string, data interface{}) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	if err := a.templates.ExecuteTemplate(w, name, data); err != nil {
+		c.Warning.Println("Rendering the admin UI failed!", err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func jsonError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func (a *admin) apiGroups(w http.ResponseWriter, r *http.Request, user string) {
+	records, err := selected(r.URL.Query())
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, groups(records))
+}
+
+func (a *admin) apiRecords(w http.ResponseWriter, r *http.Request, user string) {
+	records, err := selected(r.URL.Query())
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	total := len(records)
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = recordLimit
+	}
+	if len(records) > limit {
+		records = records[:limit]
+	}
+
+	// the list leaves out the msgs, they are fetched one at a time
+	list := []dlqRecord{}
+	for _, rec := range records {
+		short := *rec.redacted()
+		short.Msg = ""
+		list = append(list, short)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total":   total,
+		"records": list,
+	})
+}
+
+func (a *admin) apiRecord(w http.ResponseWriter, r *http.Request, user string) {
+	rec, err := store.get(strings.TrimPrefix(r.URL.Path, "/api/records/"))
+	if err != nil {
+		jsonError(w, http.StatusNotFound, errors.New("no such record"))
+		return
+	}
+
+	writeJSON(w, http.StatusOK, decode(rec))
+}
+
+// apiRequest selects the records of a replay or discard through the
+// API. At least one field has to be set.
+type apiRequest struct {
+	Ids      []string `json:"ids"`
+	Service  string   `json:"service"`
+	Code     string   `json:"code"`
+	Error    string   `json:"error"`
+	Group    *string  `json:"group"`
+	Analysis string   `json:"analysis"`
+	Since    string   `json:"since"`
+	Until    string   `json:"until"`
+	All      bool     `json:"all"`
+}
+
+func (req *apiRequest) values() url.Values {
+	v := url.Values{
+		"id":       req.Ids,
+		"service":  {req.Service},
+		"code":     {req.Code},
+		"error":    {req.Error},
+		"analysis": {req.Analysis},
+		"since":    {req.Since},
+		"until":    {req.Until},
+	}
+	if req.Group != nil {
+		v["group"] = []string{*req.Group}
+	}
+
+	return v
+}
+
+// apiAction replays or discards records. Only JSON bodies are
+// accepted, browsers don't send them to other sites without asking.
+func (a *admin) apiAction(w http.ResponseWriter, r *http.Request, user string) {
+	if r.Method != http.MethodPost {
+		jsonError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		jsonError(w, http.StatusUnsupportedMediaType, errors.New("content type has to be application/json"))
+		return
+	}
+
+	req := &apiRequest{}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(req); err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	v := req.values()
+	f, err := filterOf(v)
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, err)
+		return
+	}
+	if f.empty() && req.Group == nil && !req.All {
+		jsonError(w, http.StatusBadRequest, errors.New("ids, a filter, or all needed"))
+		return
+	}
+
+	records, err := selected(v)
+	if err != nil {
+		jsonError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	done, failed := act(actionOf(r), user, records)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"done":   done,
+		"failed": failed,
+	})
+}
+
+var templateFuncs = template.FuncMap{
+	"time": func(t time.Time) string {
+		if t.IsZero() {
+			return ""
+		}
+		return t.Format("2006-01-02 15:04:05")
+	},
+	"json": func(v interface{}) string {
+		out, _ := json.MarshalIndent(v, "", "  ")
+		return string(out)
+	},
+	"shorten": shorten,
+}
+
+const adminTemplates = `
+{{define "head"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>overseer</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border-bottom: 1px solid #ddd; padding: 0.3em 0.6em; text-align: left; vertical-align: top; }
+pre { background: #f4f4f4; padding: 1em; overflow: auto; }
+</style></head><body>
+<h1><a href="/">overseer</a> dead letters</h1>
+{{end}}
+
+{{define "foot"}}</body></html>{{end}}
+
+{{define "index"}}{{template "head"}}
+<h2>Failures by error</h2>
+<table>
+<tr><th>Count</th><th>Service</th><th>Code</th><th>Error</th><th>First</th><th>Last</th><th></th></tr>
+{{range .Groups}}
+<tr><td>{{.Count}}</td><td>{{.Service}}</td><td>{{.Code}}</td><td>{{shorten .Error 120}}</td>
+<td>{{time .First}}</td><td>{{time .Last}}</td>
+<td><a href="/?service={{.Service}}&amp;code={{.Code}}&amp;group={{.Error}}">show</a></td></tr>
+{{end}}
+</table>
+
+<h2>Messages</h2>
+<form method="get" action="/">
+<input name="service" placeholder="service" value="{{.Query.Get "service"}}">
+<input name="code" placeholder="code" value="{{.Query.Get "code"}}">
+<input name="error" placeholder="error text" value="{{.Query.Get "error"}}">
+<input name="analysis" placeholder="analysis id" value="{{.Query.Get "analysis"}}">
+<input name="since" placeholder="since" value="{{.Query.Get "since"}}">
+<input name="until" placeholder="until" value="{{.Query.Get "until"}}">
+{{with .Query.Get "group"}}<input type="hidden" name="group" value="{{.}}">{{end}}
+<button>Filter</button> <a href="/">reset</a>
+</form>
+
+<form method="post">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<p>{{.Total}} messages{{if gt .Total (len .Records)}}, showing the oldest {{len .Records}}{{end}}.
+Act on the selected ones or on all {{.Total}} matching the filter:</p>
+<p>
+<button formaction="/replay">Replay selected</button>
+<button formaction="/discard">Discard selected</button>
+</p>
+<table>
+<tr><th></th><th>Id</th><th>Dumped</th><th>Service</th><th>Code</th><th>Attempts</th><th>Analysis</th><th>Error</th></tr>
+{{range .Records}}
+<tr><td><input type="checkbox" name="id" value="{{.Id}}"></td>
+<td><a href="/records/{{.Id}}">{{.Id}}</a></td><td>{{time .DumpedAt}}</td><td>{{.Service}}</td><td>{{.Code}}</td>
+<td>{{.Attempts}}</td><td>{{.AnalysisId}}</td><td>{{shorten .Error 120}}</td></tr>
+{{end}}
+</table>
+</form>
+
+<form method="post">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input type="hidden" name="bulk" value="1">
+{{range $k, $v := .Query}}{{range $v}}<input type="hidden" name="{{$k}}" value="{{.}}">{{end}}{{end}}
+<button formaction="/replay">Replay all {{.Total}}</button>
+<button formaction="/discard">Discard all {{.Total}}</button>
+</form>
+{{template "foot"}}{{end}}
+
+{{define "record"}}{{template "head"}}
+{{with .Record}}
+<h2>{{.Id}}</h2>
+<table>
+<tr><th>Service</th><td>{{.Service}}</td></tr>
+<tr><th>Queue</th><td>{{.Queue}}</td></tr>
+<tr><th>Type</th><td>{{.Type}}</td></tr>
+<tr><th>Code</th><td>{{.Code}}</td></tr>
+<tr><th>Error</th><td>{{.Error}}</td></tr>
+<tr><th>Description</th><td>{{.Desc}}</td></tr>
+<tr><th>Reason</th><td>{{.Reason}}</td></tr>
+<tr><th>Analysis</th><td>{{.AnalysisId}}</td></tr>
+<tr><th>Attempts</th><td>{{.Attempts}}</td></tr>
+<tr><th>Created</th><td>{{time .CreatedAt}}</td></tr>
+<tr><th>Dumped</th><td>{{time .DumpedAt}}</td></tr>
+</table>
+{{if .Invalid}}
+<p>The message couldn't be decoded: {{.Invalid}}</p>
+<pre>{{.Msg}}</pre>
+{{else}}
+<h3>Envelope</h3>
+<pre>{{json .Envelope}}</pre>
+<h3>Payload</h3>
+<pre>{{json .Payload}}</pre>
+{{end}}
+<form method="post">
+<input type="hidden" name="csrf" value="{{$.CSRF}}">
+<input type="hidden" name="id" value="{{.Id}}">
+<button formaction="/replay">Replay</button>
+<button formaction="/discard">Discard</button>
+</form>
+{{end}}
+{{template "foot"}}{{end}}
+
+{{define "done"}}{{template "head"}}
+<p>{{len .Done}} messages {{if eq .Action "replay"}}replayed{{else}}discarded{{end}}.</p>
+{{if .Failed}}
+<table>
+<tr><th>Id</th><th>Error</th></tr>
+{{range $id, $err := .Failed}}<tr><td>{{$id}}</td><td>{{$err}}</td></tr>{{end}}
+</table>
+{{end}}
+<p><a href="/">back</a></p>
+{{template "foot"}}{{end}}
+`
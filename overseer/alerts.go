@@ -0,0 +1,425 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"net/smtp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cynexit/cuckoo_distributed/lib"
+)
+
+// alertConfig configures the alerts on failure spikes. Zero values
+// are replaced by the defaults.
+type alertConfig struct {
+	Rules       []*alertRule
+	Interval    int // seconds between evaluations of the rules (default 30)
+	RepeatAfter int // seconds until a firing alert is sent again (default 3600), negative to never repeat
+	Webhook     *webhookConfig
+	SMTP        *smtpConfig
+	Syslog      *syslogConfig
+}
+
+// alertRule fires once Threshold failures of a service and error
+// code happened within Window seconds. Every service and code is
+// tracked on its own.
+type alertRule struct {
+	Name      string // name of the alert, defaults to the index of the rule
+	Service   string // service which failed, empty for all
+	Code      string // error code of the failure, empty for all
+	Dumped    bool   // count dumped messages instead of failures
+	Window    int    // seconds of the sliding window (default 300)
+	Threshold int    // failures within the window to fire (default 100)
+}
+
+type webhookConfig struct {
+	URL     string            // URL the alerts are POSTed to as JSON
+	Headers map[string]string // additional headers, e.g. for authentication
+}
+
+type smtpConfig struct {
+	Addr     string // host:port of the mail server
+	From     string
+	To       []string
+	Username string // empty for no authentication
+	Password string
+}
+
+type syslogConfig struct {
+	Network string // "udp", "tcp", or empty for the local syslog
+	Addr    string
+	Tag     string // defaults to "overseer"
+}
+
+// Alert states.
+const (
+	alertFiring   = "firing"
+	alertResolved = "resolved"
+)
+
+// alert is what the notifiers send.
+type alert struct {
+	Rule      string    `json:"rule"`
+	State     string    `json:"state"`
+	Service   string    `json:"service"`
+	Code      string    `json:"code"`
+	Dumped    bool      `json:"dumped"`
+	Count     int       `json:"count"`
+	Threshold int       `json:"threshold"`
+	Window    int       `json:"window"`
+	Since     time.Time `json:"since"` // when the alert started firing
+	At        time.Time `json:"at"`
+}
+
+func (a *alert) subject() string {
+	what := "failures"
+	if a.Dumped {
+		what = "dumped messages"
+	}
+
+	if a.State == alertResolved {
+		return fmt.Sprintf("[RESOLVED] %s: %s %s (%s) back below %d", a.Rule, a.Service, what, a.Code, a.Threshold)
+	}
+
+	return fmt.Sprintf("[FIRING] %s: %d %s of %s (%s) in the last %ds", a.Rule, a.Count, what, a.Service, a.Code, a.Window)
+}
+
+// notifier sends alerts somewhere.
+type notifier interface {
+	name() string
+	notify(a *alert) error
+}
+
+// failureKey is what failures are tracked by.
+type failureKey struct {
+	service string
+	code    string
+	dumped  bool
+}
+
+// alertKey identifies an alert for the de-duplication.
+type alertKey struct {
+	rule    int
+	service string
+	code    string
+}
+
+type firing struct {
+	since time.Time
+	sent  time.Time
+}
+
+type alerter struct {
+	mutex       *sync.Mutex
+	rules       []*alertRule
+	repeatAfter time.Duration
+	notifiers   []notifier
+	maxWindow   time.Duration
+	failures    map[failureKey][]time.Time
+	firing      map[alertKey]*firing
+	sent        *lib.Counter
+	errors      *lib.Counter
+}
+
+// alerts is nil unless alerting is configured.
+var alerts *alerter
+
+// setupAlerts checks the config and starts evaluating the rules.
+func setupAlerts(conf *alertConfig) {
+	if conf == nil || len(conf.Rules) == 0 {
+		return
+	}
+
+	if conf.Interval <= 0 {
+		conf.Interval = 30
+	}
+	if conf.RepeatAfter == 0 {
+		conf.RepeatAfter = 3600
+	}
+
+	a := &alerter{
+		mutex:       &sync.Mutex{},
+		rules:       conf.Rules,
+		repeatAfter: time.Duration(conf.RepeatAfter) * time.Second,
+		failures:    make(map[failureKey][]time.Time),
+		firing:      make(map[alertKey]*firing),
+		sent:        c.Metrics.NewCounter("overseer_alerts_total", "Alerts sent per rule and state.", "rule", "state"),
+		errors:      c.Metrics.NewCounter("overseer_alert_errors_total", "Alerts which couldn't be sent per notifier.", "notifier"),
+	}
+
+	for i, r := range a.rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule %d", i)
+		}
+		if r.Window <= 0 {
+			r.Window = 300
+		}
+		if r.Threshold <= 0 {
+			r.Threshold = 100
+		}
+
+		if w := time.Duration(r.Window) * time.Second; w > a.maxWindow {
+			a.maxWindow = w
+		}
+	}
+
+	if conf.Webhook != nil {
+		a.notifiers = append(a.notifiers, &webhook{conf.Webhook, &http.Client{Timeout: 10 * time.Second}})
+	}
+	if conf.SMTP != nil {
+		a.notifiers = append(a.notifiers, &mailer{conf.SMTP})
+	}
+	if conf.Syslog != nil {
+		s, err := newSyslog(conf.Syslog)
+		c.FailOnError(err, "Couldn't connect to syslog!")
+		a.notifiers = append(a.notifiers, s)
+	}
+
+	if len(a.notifiers) == 0 {
+		c.Warning.Println("Alert rules are set but no notifier, alerts are only logged!")
+	}
+
+	alerts = a
+
+	go func() {
+		for range time.Tick(time.Duration(conf.Interval) * time.Second) {
+			a.evaluate(time.Now())
+		}
+	}()
+}
+
+// failed records a failure of the service. Dumped messages are
+// recorded once more with dumped set.
+func (a *alerter) failed(service, code string, dumped bool) {
+	if a == nil {
+		return
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	k := failureKey{service, code, dumped}
+	a.failures[k] = append(a.failures[k], time.Now())
+}
+
+// count returns the failures matching the rule since the given time
+// by service and code.
+func (a *alerter) count(r *alertRule, since time.Time) map[alertKey]int {
+	counts := make(map[alertKey]int)
+
+	for k, times := range a.failures {
+		if r.Service != "" && r.Service != k.service {
+			continue
+		}
+		if r.Code != "" && r.Code != k.code {
+			continue
+		}
+		if r.Dumped != k.dumped {
+			continue
+		}
+
+		// the times are sorted, count the ones within the window
+		n := len(times) - sort.Search(len(times), func(i int) bool {
+			return !times[i].Before(since)
+		})
+		counts[alertKey{service: k.service, code: k.code}] += n
+	}
+
+	return counts
+}
+
+// evaluate sends the alerts which are due at now.
+func (a *alerter) evaluate(now time.Time) {
+	// sending may take a while, failures are still recorded meanwhile
+	for _, alert := range a.due(now) {
+		a.send(alert)
+	}
+}
+
+// due checks the rules, fires new alerts, repeats or resolves
+// firing ones, and forgets failures outside every window. It
+// returns the alerts to send.
+func (a *alerter) due(now time.Time) []*alert {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for k, times := range a.failures {
+		i := sort.Search(len(times), func(i int) bool {
+			return !times[i].Before(now.Add(-a.maxWindow))
+		})
+		if i == len(times) {
+			delete(a.failures, k)
+		} else {
+			a.failures[k] = times[i:]
+		}
+	}
+
+	pending := []*alert{}
+	for i, r := range a.rules {
+		counts := a.count(r, now.Add(-time.Duration(r.Window)*time.Second))
+
+		for k, n := range counts {
+			if n < r.Threshold {
+				continue
+			}
+
+			k.rule = i
+			f, exists := a.firing[k]
+			if !exists {
+				f = &firing{since: now}
+				a.firing[k] = f
+			} else if a.repeatAfter < 0 || now.Sub(f.sent) < a.repeatAfter {
+				continue
+			}
+
+			f.sent = now
+			pending = append(pending, a.alertOf(r, k, alertFiring, n, f, now))
+		}
+
+		for k, f := range a.firing {
+			if k.rule != i {
+				continue
+			}
+
+			n := counts[alertKey{service: k.service, code: k.code}]
+			if n >= r.Threshold {
+				continue
+			}
+
+			delete(a.firing, k)
+			pending = append(pending, a.alertOf(r, k, alertResolved, n, f, now))
+		}
+	}
+
+	return pending
+}
+
+func (a *alerter) alertOf(r *alertRule, k alertKey, state string, n int, f *firing, now time.Time) *alert {
+	return &alert{
+		Rule:      r.Name,
+		State:     state,
+		Service:   k.service,
+		Code:      k.code,
+		Dumped:    r.Dumped,
+		Count:     n,
+		Threshold: r.Threshold,
+		Window:    r.Window,
+		Since:     f.since,
+		At:        now,
+	}
+}
+
+// send passes the alert to every notifier.
+func (a *alerter) send(alert *alert) {
+	c.Warning.Println("[ALERT]", alert.subject())
+	a.sent.Inc(alert.Rule, alert.State)
+
+	for _, n := range a.notifiers {
+		if err := n.notify(alert); err != nil {
+			c.Warning.Printf("Sending the alert with %s failed! %s\n", n.name(), err)
+			a.errors.Inc(n.name())
+		}
+	}
+}
+
+// webhook POSTs alerts as JSON.
+type webhook struct {
+	conf   *webhookConfig
+	client *http.Client
+}
+
+func (w *webhook) name() string {
+	return "webhook"
+}
+
+func (w *webhook) notify(a *alert) error {
+	body, err := json.Marshal(struct {
+		*alert
+		Text string `json:"text"`
+	}{a, a.subject()})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", w.conf.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.conf.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return errors.New("webhook answered with " + resp.Status)
+	}
+
+	return nil
+}
+
+// mailer sends alerts by mail.
+type mailer struct {
+	conf *smtpConfig
+}
+
+func (m *mailer) name() string {
+	return "smtp"
+}
+
+func (m *mailer) notify(a *alert) error {
+	var auth smtp.Auth
+	if m.conf.Username != "" {
+		host := strings.Split(m.conf.Addr, ":")[0]
+		auth = smtp.PlainAuth("", m.conf.Username, m.conf.Password, host)
+	}
+
+	details, _ := json.MarshalIndent(a, "", "  ")
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n\r\n%s\r\n",
+		m.conf.From, strings.Join(m.conf.To, ", "), a.subject(), a.At.Format(time.RFC1123Z), a.subject(), details)
+
+	return smtp.SendMail(m.conf.Addr, auth, m.conf.From, m.conf.To, []byte(msg))
+}
+
+// syslogger writes alerts to syslog.
+type syslogger struct {
+	w *syslog.Writer
+}
+
+func newSyslog(conf *syslogConfig) (*syslogger, error) {
+	if conf.Tag == "" {
+		conf.Tag = "overseer"
+	}
+
+	w, err := syslog.Dial(conf.Network, conf.Addr, syslog.LOG_WARNING|syslog.LOG_DAEMON, conf.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &syslogger{w}, nil
+}
+
+func (s *syslogger) name() string {
+	return "syslog"
+}
+
+func (s *syslogger) notify(a *alert) error {
+	if a.State == alertResolved {
+		return s.w.Notice(a.subject())
+	}
+
+	return s.w.Warning(a.subject())
+}
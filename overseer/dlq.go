@@ -0,0 +1,451 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cynexit/cuckoo_distributed/lib"
+	"github.com/streadway/amqp"
+)
+
+// dlqRecord is a message the overseer gave up on. Records are kept
+// in the dump dir, one JSON file per message.
+type dlqRecord struct {
+	Id         string    `json:"id"`
+	Service    string    `json:"service"`     // service which failed
+	Queue      string    `json:"queue"`       // queue the msg is replayed to
+	Type       string    `json:"type"`        // type of Msg
+	Code       string    `json:"code"`        // error code of the failure
+	Error      string    `json:"error"`       // error of the failure
+	Desc       string    `json:"desc"`        // description of the failure
+	Reason     string    `json:"reason"`      // why the overseer gave up
+	AnalysisId string    `json:"analysis_id"` // crits analysis
+	Attempts   int       `json:"attempts"`    // resubmissions before the msg was dumped
+	CreatedAt  time.Time `json:"created_at"`  // when the msg was created, if known
+	DumpedAt   time.Time `json:"dumped_at"`
+	Msg        string    `json:"msg"`
+}
+
+// dlqStore is the dead-letter store in the dump dir.
+type dlqStore struct {
+	dir string
+}
+
+const dlqFileMode = 0640
+
+// newRecord returns the record of a failed msg, the caller sets
+// the fields which can't be taken from failed.
+func newRecord(msg *amqp.Delivery, failed *lib.FailedMsg, reason string) *dlqRecord {
+	return &dlqRecord{
+		Service:  failed.Service,
+		Queue:    failed.Queue,
+		Type:     lib.ConsumedTypes[failed.Service],
+		Code:     failed.Code,
+		Error:    failed.Error,
+		Desc:     failed.Desc,
+		Reason:   reason,
+		Attempts: lib.AttemptOf(msg),
+		Msg:      failed.Msg,
+	}
+}
+
+// redacted returns a copy of the record without secrets for
+// display. The record itself keeps them, it has to be replayed.
+func (r *dlqRecord) redacted() *dlqRecord {
+	redacted := *r
+	redacted.Error = lib.Redact(r.Error)
+	redacted.Desc = lib.Redact(r.Desc)
+	redacted.Msg = lib.Redact(r.Msg)
+
+	return &redacted
+}
+
+// add writes a new record. The msg is stored as it is, so only the
+// owner and group of the dump dir may read it.
+func (s *dlqStore) add(r *dlqRecord) error {
+	fsMutex.Lock()
+	defer fsMutex.Unlock()
+
+	r.DumpedAt = time.Now().UTC()
+
+	for counter := 0; ; counter++ {
+		r.Id = fmt.Sprintf("%d_%d", r.DumpedAt.Unix(), counter)
+
+		fp, err := os.OpenFile(s.path(r.Id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, dlqFileMode)
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		err = json.NewEncoder(fp).Encode(r)
+		fp.Close()
+		return err
+	}
+}
+
+func (s *dlqStore) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+// get reads a single record.
+func (s *dlqStore) get(id string) (*dlqRecord, error) {
+	if strings.ContainsAny(id, "/\\") {
+		return nil, errors.New("invalid id " + id)
+	}
+
+	if _, err := os.Stat(s.path(id)); err == nil {
+		return s.read(id + ".json")
+	}
+
+	// dumps written before the store existed
+	return s.read(id)
+}
+
+// read reads the record in file. Files without the .json extension
+// are dumps of older versions, which only contain the raw msg.
+func (s *dlqStore) read(file string) (*dlqRecord, error) {
+	content, err := ioutil.ReadFile(filepath.Join(s.dir, file))
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(file, ".json") {
+		r := &dlqRecord{}
+		err = json.Unmarshal(content, r)
+		return r, err
+	}
+
+	r := &dlqRecord{
+		Id:     file,
+		Queue:  failedQueue,
+		Type:   lib.MsgTypeFailed,
+		Reason: "dumped by an older version",
+		Msg:    string(content),
+	}
+
+	if unix, err := strconv.ParseInt(strings.Split(file, "_")[0], 10, 64); err == nil {
+		r.DumpedAt = time.Unix(unix, 0).UTC()
+	}
+
+	// the old dumps hold failed msgs, which are replayed to the
+	// failed queue as before
+	failed := &lib.FailedMsg{}
+	if _, err := lib.OpenEnvelope(content, lib.MsgTypeFailed, failed); err == nil {
+		r.Service = failed.Service
+		r.Code = failed.Code
+		r.Error = failed.Error
+		r.Desc = failed.Desc
+
+		if data, err := lib.CritsDataOf([]byte(failed.Msg), lib.ConsumedTypes[failed.Service]); err == nil {
+			r.AnalysisId = data.AnalysisId
+		}
+	}
+
+	return r, nil
+}
+
+// all returns all records, oldest first.
+func (s *dlqStore) all() ([]*dlqRecord, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	records := []*dlqRecord{}
+	for _, f := range files {
+		if f.IsDir() || f.Name() == "__test" || strings.HasPrefix(f.Name(), ".") {
+			continue
+		}
+
+		r, err := s.read(f.Name())
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("reading %s failed: %s", f.Name(), err))
+		}
+		records = append(records, r)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].DumpedAt.Before(records[j].DumpedAt)
+	})
+
+	return records, nil
+}
+
+// exists checks if the record wasn't removed yet.
+func (s *dlqStore) exists(id string) bool {
+	if _, err := os.Stat(s.path(id)); err == nil {
+		return true
+	}
+
+	_, err := os.Stat(filepath.Join(s.dir, id))
+	return err == nil
+}
+
+// remove deletes a record.
+func (s *dlqStore) remove(id string) error {
+	fsMutex.Lock()
+	defer fsMutex.Unlock()
+
+	return s.del(id)
+}
+
+func (s *dlqStore) del(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		err = os.Remove(filepath.Join(s.dir, id))
+	}
+
+	return err
+}
+
+// dlqFilter selects records, empty fields match everything.
+type dlqFilter struct {
+	service    string
+	code       string
+	errText    string
+	analysisId string
+	since      time.Time
+	until      time.Time
+	ids        map[string]bool
+}
+
+func (f *dlqFilter) empty() bool {
+	return f.service == "" && f.code == "" && f.errText == "" && f.analysisId == "" &&
+		f.since.IsZero() && f.until.IsZero() && len(f.ids) == 0
+}
+
+func (f *dlqFilter) match(r *dlqRecord) bool {
+	if len(f.ids) > 0 && !f.ids[r.Id] {
+		return false
+	}
+	if f.service != "" && f.service != r.Service {
+		return false
+	}
+	if f.code != "" && f.code != r.Code {
+		return false
+	}
+	if f.analysisId != "" && f.analysisId != r.AnalysisId {
+		return false
+	}
+	if f.errText != "" && !strings.Contains(strings.ToLower(r.Error+" "+r.Desc+" "+r.Reason), strings.ToLower(f.errText)) {
+		return false
+	}
+	if !f.since.IsZero() && r.DumpedAt.Before(f.since) {
+		return false
+	}
+	if !f.until.IsZero() && !r.DumpedAt.Before(f.until) {
+		return false
+	}
+
+	return true
+}
+
+// find returns the records matching the filter.
+func (s *dlqStore) find(f *dlqFilter) ([]*dlqRecord, error) {
+	records, err := s.all()
+	if err != nil {
+		return nil, err
+	}
+
+	matching := []*dlqRecord{}
+	for _, r := range records {
+		if f.match(r) {
+			matching = append(matching, r)
+		}
+	}
+
+	return matching, nil
+}
+
+// replay sends the msg of a record to its queue with the attempts
+// reset and removes the record.
+func (s *dlqStore) replay(r *dlqRecord) error {
+	body, err := lib.Replay([]byte(r.Msg), r.Type)
+	if err != nil {
+		return err
+	}
+
+	// the store is shared with the admin server, make sure the
+	// record wasn't replayed or purged in the meantime
+	fsMutex.Lock()
+	defer fsMutex.Unlock()
+
+	if !s.exists(r.Id) {
+		return errors.New("record " + r.Id + " doesn't exist anymore")
+	}
+
+	resubmit(r.Queue, body, 0, 0, nil)
+	return s.del(r.Id)
+}
+
+// parseTime accepts dates and RFC 3339 timestamps.
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+const dlqUsage = `Usage: overseer dlq <command> [options] [id ...]
+
+Commands:
+  list     list the dead-lettered messages
+  show     print the records with the given ids
+  replay   send the messages to their original queues and remove them
+  purge    remove the messages
+
+replay and purge need ids, a filter, or -all.
+
+Options:
+`
+
+// dlqMain runs the dlq subcommands.
+func dlqMain(args []string) {
+	fs := flag.NewFlagSet("dlq", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(os.Stderr, dlqUsage)
+		fs.PrintDefaults()
+	}
+
+	var confPath, since, until string
+	var all, dryRun bool
+	f := &dlqFilter{ids: make(map[string]bool)}
+	fs.StringVar(&confPath, "config", "", "Path to the config file")
+	fs.StringVar(&f.service, "service", "", "Only messages which failed in this service")
+	fs.StringVar(&f.code, "code", "", "Only messages which failed with this error code")
+	fs.StringVar(&f.errText, "error", "", "Only messages whose error contains this text")
+	fs.StringVar(&f.analysisId, "analysis", "", "Only messages of this crits analysis id")
+	fs.StringVar(&since, "since", "", "Only messages dumped at or after this date or time (2006-01-02 or RFC 3339)")
+	fs.StringVar(&until, "until", "", "Only messages dumped before this date or time")
+	fs.BoolVar(&all, "all", false, "Replay or purge all messages")
+	fs.BoolVar(&dryRun, "n", false, "Only print what would be replayed or purged")
+
+	if len(args) == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	cmd := args[0]
+	fs.Parse(args[1:])
+
+	var err error
+	if f.since, err = parseTime(since); err != nil {
+		dlqFail(err)
+	}
+	if f.until, err = parseTime(until); err != nil {
+		dlqFail(err)
+	}
+	for _, id := range fs.Args() {
+		f.ids[id] = true
+	}
+
+	conf := loadConfig(confPath)
+	failedQueue = conf.ConsumerQueue
+	store := &dlqStore{conf.DumpDir}
+
+	switch cmd {
+	case "list":
+		records, err := store.find(f)
+		if err != nil {
+			dlqFail(err)
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tDUMPED\tSERVICE\tCODE\tATTEMPTS\tANALYSIS\tERROR")
+		for _, r := range records {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n", r.Id, r.DumpedAt.Format(time.RFC3339), r.Service, r.Code, r.Attempts, r.AnalysisId, shorten(lib.Redact(r.Error), 80))
+		}
+		w.Flush()
+
+	case "show":
+		if len(f.ids) == 0 {
+			dlqFail(errors.New("show needs the ids of the records"))
+		}
+
+		for id := range f.ids {
+			r, err := store.get(id)
+			if err != nil {
+				dlqFail(err)
+			}
+
+			out, _ := json.MarshalIndent(r.redacted(), "", "  ")
+			fmt.Println(string(out))
+		}
+
+	case "replay", "purge":
+		if f.empty() && !all {
+			dlqFail(errors.New(cmd + " needs ids, a filter, or -all"))
+		}
+
+		records, err := store.find(f)
+		if err != nil {
+			dlqFail(err)
+		}
+
+		if cmd == "replay" && !dryRun {
+			setupCore(conf)
+		}
+
+		pastTense := map[string]string{"replay": "replayed", "purge": "purged"}
+
+		done := 0
+		for _, r := range records {
+			if dryRun {
+				fmt.Printf("would %s %s (%s, %s)\n", cmd, r.Id, r.Service, r.Queue)
+				continue
+			}
+
+			if cmd == "replay" {
+				err = store.replay(r)
+			} else {
+				err = store.remove(r.Id)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s of %s failed: %s\n", cmd, r.Id, err)
+				continue
+			}
+
+			fmt.Printf("%s %s\n", pastTense[cmd], r.Id)
+			done += 1
+		}
+
+		if !dryRun {
+			fmt.Printf("%s %d of %d messages\n", pastTense[cmd], done, len(records))
+		}
+
+	default:
+		fs.Usage()
+		os.Exit(2)
+	}
+}
+
+func dlqFail(err error) {
+	fmt.Fprintln(os.Stderr, "Error:", err)
+	os.Exit(1)
+}
+
+// shorten cuts s to n runes for the listing.
+func shorten(s string, n int) string {
+	s = strings.Replace(s, "\n", " ", -1)
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-3]) + "..."
+	}
+
+	return s
+}
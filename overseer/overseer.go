@@ -7,8 +7,10 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"sync"
 	"time"
@@ -22,32 +24,101 @@ type config struct {
 	ConsumerQueue string
 	PrefetchCount int
 	DumpDir       string
+	RetryPolicies []*retryPolicy
+	StageQueues   map[string]string
+	MonitorAddr   string
+	Admin         *adminConfig
+	Alerts        *alertConfig
+	Tracing       *lib.TraceConfig
+	Security      *lib.SecurityConfig
 	LogFile       string
 	LogLevel      string
+	LogFormat     string
+	LogMaxSize    int
+	LogMaxBackups int
 }
 
-type genericMsg struct {
-	//TODO: make this shit better....
-	CritsData  *lib.CritsData `json:"CritsData"`
-	CritsDataJ *lib.CritsData `json:"crits_data"`
+// retryPolicy decides how often and when failed messages are
+// resubmitted. Zero values are replaced by the defaults.
+type retryPolicy struct {
+	Service      string   // service which failed, empty for all
+	Code         string   // error code of the failure, empty for all
+	Errors       string   // regexp matched against error and description, empty for all
+	MaxAttempts  int      // resubmissions before the message is dumped (default 3), negative to never resubmit
+	BackoffMin   int      // seconds before the first resubmission (default 60)
+	BackoffMax   int      // maximum seconds between resubmissions (default 3600)
+	Jitter       float64  // chance of using the next shorter or longer delay instead (default 0.2), negative to disable
+	NonRetryable []string // regexps of errors which are dumped right away
+
+	errors       *regexp.Regexp
+	nonRetryable []*regexp.Regexp
+	steps        []time.Duration // the delays resubmissions can wait
 }
 
 var (
-	fsMutex   = &sync.Mutex{}
-	mapMutex  = &sync.Mutex{}
-	c         *lib.Core
-	dumpDir   string
-	producers = make(map[string]*lib.QueueHandler)
-	failedMap = make(map[string]int)
+	fsMutex     = &sync.Mutex{}
+	mapMutex    = &sync.Mutex{}
+	c           *lib.Core
+	dumpDir     string
+	store       *dlqStore
+	failedQueue string
+	producers   = make(map[string]*lib.QueueHandler)
+	policies    []*retryPolicy
+	retries     *lib.Counter
+	dumps       *lib.Counter
+
+	// queues of the services a failed msg can be restarted at
+	stageQueues = map[string]string{
+		"feed_cuckoo":      "worker/feed_cuckoo",
+		"check_results":    "worker/check_results",
+		"parse_and_submit": "worker/parse_and_submit",
+	}
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "dlq" {
+		dlqMain(os.Args[2:])
+		return
+	}
+
 	var doResubmitDumped bool
 	var confPath string
-	flag.BoolVar(&doResubmitDumped, "resubmitDumped", false, "Resubmit all files in the dump dir to the failed queue")
+	flag.BoolVar(&doResubmitDumped, "resubmitDumped", false, "Replay all messages in the dump dir (deprecated, use dlq replay -all)")
 	flag.StringVar(&confPath, "config", "", "Path to the config file")
 	flag.Parse()
 
+	conf := loadConfig(confPath)
+
+	// setup
+	setupCore(conf)
+	retries = c.Metrics.NewCounter("overseer_retries_total", "Failed messages resubmitted to their queue.", "queue")
+	dumps = c.Metrics.NewCounter("overseer_dumps_total", "Failed messages dumped to the dump dir.")
+
+	dumpDir = conf.DumpDir
+	store = &dlqStore{dumpDir}
+	failedQueue = conf.ConsumerQueue
+	testDumpDir()
+	setupPolicies(conf.RetryPolicies)
+	for stage, queue := range conf.StageQueues {
+		stageQueues[stage] = queue
+	}
+
+	if doResubmitDumped {
+		resubmitDumped()
+		return
+	}
+
+	setupAlerts(conf.Alerts)
+
+	c.AddReadyCheck("dump_dir", func() (interface{}, error) {
+		return dumpDir, checkDumpDir()
+	})
+	c.StartMonitor(conf.MonitorAddr)
+	startAdmin(conf.Admin)
+	c.Consume(conf.ConsumerQueue, conf.PrefetchCount, parseMsg)
+}
+
+func loadConfig(confPath string) *config {
 	if confPath == "" {
 		confPath, _ = filepath.Abs(filepath.Dir(os.Args[0]))
 		confPath += "/overseer.conf.json"
@@ -61,168 +132,318 @@ func main() {
 		panic("Could not decode overseer.conf.json without errors! " + err.Error())
 	}
 
-	// setup
-	c = lib.Init("overseer", conf.Amqp, conf.LogFile, conf.LogLevel, conf.ConsumerQueue, true)
-
-	dumpDir = conf.DumpDir
-	testDumpDir()
-
-	if doResubmitDumped {
-		resubmitDumped(conf.ConsumerQueue)
-		return
-	}
+	return conf
+}
 
-	c.Consume(conf.ConsumerQueue, conf.PrefetchCount, parseMsg)
+func setupCore(conf *config) {
+	c = lib.Init("overseer", conf.Amqp, &lib.LogConfig{conf.LogFile, conf.LogLevel, conf.LogFormat, conf.LogMaxSize, conf.LogMaxBackups}, conf.ConsumerQueue, true)
+	c.SetupTracing(conf.Tracing)
+	c.SetupSecurity(conf.Security)
 }
 
 func parseMsg(msg amqp.Delivery) {
 	m := &lib.FailedMsg{}
-	err := json.Unmarshal(msg.Body, m)
+	_, err := lib.OpenEnvelope(msg.Body, lib.MsgTypeFailed, m)
 	if err != nil {
 		c.Info.Println("parseMsg couldn't decode the msg body!")
-		dumpMsg(&msg)
+		dump(&msg, &dlqRecord{
+			Queue:    failedQueue,
+			Type:     lib.MsgTypeFailed,
+			Error:    err.Error(),
+			Reason:   "undecodable failed msg",
+			Attempts: lib.AttemptOf(&msg),
+			Msg:      string(msg.Body),
+		})
 		return
 	}
 
-	go handleFailed(m, &msg)
+	// resubmissions are delayed by the broker, there is
+	// nothing to wait for here.
+	alerts.failed(m.Service, m.Code, false)
+	handleFailed(m, &msg)
 }
 
-func dumpMsg(msg *amqp.Delivery) {
-	fsMutex.Lock()
-	defer fsMutex.Unlock()
+// setupPolicies compiles the configured policies and adds the
+// default policy, which matches every message, at the end.
+func setupPolicies(conf []*retryPolicy) {
+	policies = append(conf, &retryPolicy{})
+
+	for _, p := range policies {
+		if p.MaxAttempts == 0 {
+			p.MaxAttempts = 3
+		}
+		if p.BackoffMin <= 0 {
+			p.BackoffMin = 60
+		}
+		if p.BackoffMax <= 0 {
+			p.BackoffMax = 3600
+		}
+		if p.Jitter == 0 {
+			p.Jitter = 0.2
+		}
+		p.steps = backoffSteps(p.BackoffMin, p.BackoffMax)
 
-	counter := 0
-	baseFileName := fmt.Sprintf("%s/%d_", dumpDir, time.Now().Unix())
-	fileName := ""
+		var err error
+		if p.Errors != "" {
+			p.errors, err = regexp.Compile(p.Errors)
+			c.FailOnError(err, "Invalid Errors of retry policy!")
+		}
 
-	for {
-		fileName = fmt.Sprintf("%s%d", baseFileName, counter)
-		if _, err := os.Stat(fileName); os.IsNotExist(err) {
-			break
+		for _, e := range p.NonRetryable {
+			re, err := regexp.Compile(e)
+			c.FailOnError(err, "Invalid NonRetryable of retry policy!")
+			p.nonRetryable = append(p.nonRetryable, re)
 		}
-		counter += 1
 	}
+}
 
-	fp, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, os.ModePerm)
-	c.FailOnError(err, "Couldn't create new file!")
-	defer fp.Close()
+// policyFor returns the first policy matching the failed message.
+func policyFor(failed *lib.FailedMsg) *retryPolicy {
+	reason := failed.Error + " " + failed.Desc
+
+	for _, p := range policies {
+		if p.Service != "" && p.Service != failed.Service {
+			continue
+		}
+		if p.Code != "" && p.Code != failed.Code {
+			continue
+		}
+		if p.errors != nil && !p.errors.MatchString(reason) {
+			continue
+		}
+
+		return p
+	}
+
+	return policies[len(policies)-1]
+}
+
+// retryable checks if the error of the message may go away.
+func (p *retryPolicy) retryable(failed *lib.FailedMsg) bool {
+	if !failed.Retryable {
+		return false
+	}
+
+	reason := failed.Error + " " + failed.Desc
+
+	for _, re := range p.nonRetryable {
+		if re.MatchString(reason) {
+			return false
+		}
+	}
+
+	return p.MaxAttempts > 0
+}
+
+// backoffSteps returns min doubled until max is reached, and max.
+// Every distinct delay needs its own delay queue, so resubmissions
+// only wait one of these.
+func backoffSteps(min, max int) []time.Duration {
+	steps := []time.Duration{}
+	for d := min; d < max; d *= 2 {
+		steps = append(steps, time.Duration(d)*time.Second)
+	}
+
+	return append(steps, time.Duration(max)*time.Second)
+}
+
+// delay returns how long to wait before the given attempt. The
+// delay doubles with every attempt, the jitter keeps messages which
+// failed at the same time from being resubmitted at the same time
+// by picking the step next to it now and then.
+func (p *retryPolicy) delay(attempt int) time.Duration {
+	last := len(p.steps) - 1
+
+	step := attempt - 1
+	if step > last {
+		step = last
+	}
+	if step < 0 {
+		step = 0
+	}
+
+	if p.Jitter > 0 && last > 0 && rand.Float64() < p.Jitter {
+		if step == last || (step > 0 && rand.Intn(2) == 0) {
+			step -= 1
+		} else {
+			step += 1
+		}
+	}
 
-	_, err = fp.Write(msg.Body)
-	c.FailOnError(err, "Couldn't write to the file!")
-	msg.Ack(false)
+	return p.steps[step]
+}
+
+// dump moves the msg to the dead-letter store.
+func dump(msg *amqp.Delivery, r *dlqRecord) {
+	err := store.add(r)
+	c.FailOnError(err, "Couldn't write to the dump dir!")
+	dumps.Inc()
+	alerts.failed(r.Service, r.Code, true)
+	c.Ack(msg)
 }
 
 func testDumpDir() {
+	err := checkDumpDir()
+	c.FailOnError(err, "Testing the dump dir failed!")
+}
+
+// checkDumpDir writes a file to the dump dir and reads it back
+// to make sure failed messages can be dumped.
+func checkDumpDir() error {
+	fsMutex.Lock()
+	defer fsMutex.Unlock()
+
 	fileName := dumpDir + "/__test"
 	fileContent := []byte("testing is so much fun!")
 
 	_ = os.Remove(fileName)
 	fp, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, os.ModePerm)
-	c.FailOnError(err, "Testing the dump dir failed! Couldn't create new file!")
+	if err != nil {
+		return errors.New("Couldn't create new file! " + err.Error())
+	}
 
 	_, err = fp.Write(fileContent)
-	c.FailOnError(err, "Testing the dump dir failed! Couldn't write to the file!")
 	fp.Close()
+	if err != nil {
+		return errors.New("Couldn't write to the file! " + err.Error())
+	}
 
 	fp, err = os.OpenFile(fileName, os.O_RDWR|os.O_CREATE, os.ModePerm)
-	c.FailOnError(err, "Testing the dump dir failed! Couldn't write to the file!")
+	if err != nil {
+		return errors.New("Couldn't open the file! " + err.Error())
+	}
 	defer fp.Close()
 
 	reader := bufio.NewReader(fp)
 	contents, _ := ioutil.ReadAll(reader)
 
 	if string(contents) != string(fileContent) {
-		c.FailOnError(errors.New("Testing the dump dir failed! Couldn't read from the file!"), "")
+		return errors.New("Couldn't read from the file!")
 	}
 
-	_ = os.Remove(fileName)
+	return os.Remove(fileName)
 }
 
-func resubmitDumped(queue string) {
-	failed := c.SetupQueue(queue)
+// resubmitDumped replays every msg in the dump dir.
+func resubmitDumped() {
+	records, err := store.all()
+	c.FailOnError(err, "Couldn't read the dump dir!")
 
-	files, _ := ioutil.ReadDir(dumpDir)
-	for _, f := range files {
-		if f.IsDir() {
-			continue
+	for _, r := range records {
+		if err := store.replay(r); err != nil {
+			c.Warning.Printf("Replaying %s failed! %s\n", r.Id, err)
 		}
+	}
+}
 
-		fname := dumpDir + "/" + f.Name()
+func handleFailed(failed *lib.FailedMsg, msg *amqp.Delivery) {
+	c := c.WithMsg(msg, nil, 0, "").With(lib.Fields{"queue": failed.Queue, "failed_service": failed.Service, "code": failed.Code})
 
-		fp, err := os.OpenFile(fname, os.O_RDWR|os.O_CREATE, os.ModePerm)
-		c.FailOnError(err, "Couldn't open file!")
+	next, r := plan(failed, msg)
+	if r.AnalysisId != "" {
+		c = c.With(lib.Fields{"analysis_id": r.AnalysisId})
+	}
 
-		reader := bufio.NewReader(fp)
-		contents, err := ioutil.ReadAll(reader)
-		c.FailOnError(err, "Couldn't read file!")
-		fp.Close()
+	if next == nil {
+		c.Info.Printf("Dumping msg, %s: %s\n", r.Reason, failed.Error)
+		dump(msg, r)
+		return
+	}
 
-		failed.Send(contents)
+	c.Info.Printf("Resubmitting to %s in %s, attempt %d of %d\n", next.queue, next.delay, next.attempt, next.maxAttempts)
 
-		_ = os.Remove(fname)
-	}
+	resubmit(next.queue, next.body, next.attempt, next.delay, msg)
+	retries.Inc(next.queue)
+	c.Ack(msg)
+}
 
+// resubmission is how a failed msg is retried.
+type resubmission struct {
+	queue       string
+	body        []byte
+	attempt     int
+	maxAttempts int
+	delay       time.Duration
 }
 
-func handleFailed(failed *lib.FailedMsg, msg *amqp.Delivery) {
-	payload := &genericMsg{}
-	err := json.Unmarshal([]byte(failed.Msg), payload)
-	if err != nil {
-		c.Info.Println("Couldn't decode genericMsg!")
-		dumpMsg(msg)
-		return
+// plan decides what happens to a failed msg. It returns how the msg
+// is resubmitted, or nil if it is dumped with the returned record.
+func plan(failed *lib.FailedMsg, msg *amqp.Delivery) (*resubmission, *dlqRecord) {
+	// by default the msg is resubmitted to the queue it failed in,
+	// the service may ask to restart at another stage.
+	queue := failed.Queue
+	msgType := lib.ConsumedTypes[failed.Service]
+	original := failed.Msg
+	r := newRecord(msg, failed, "")
+	if failed.Stage != "" && failed.Stage != failed.Service {
+		var exists bool
+		if queue, exists = stageQueues[failed.Stage]; !exists {
+			r.Reason = "unknown stage " + failed.Stage
+			return nil, r
+		}
+		msgType = lib.ConsumedTypes[failed.Stage]
 	}
-
-	aid := ""
-	if payload.CritsData != nil {
-		aid = payload.CritsData.AnalysisId
-	} else if payload.CritsDataJ != nil {
-		aid = payload.CritsDataJ.AnalysisId
-	} else {
-		c.Info.Println("Couldn't find CritsData!")
-		dumpMsg(msg)
-		return
+	if failed.Restart != "" {
+		original = failed.Restart
 	}
 
-	_, set := failedMap[aid]
-	if !set {
-		failedMap[aid] = 0
+	s, err := strconv.Unquote(original)
+	if err != nil {
+		s = original
 	}
 
-	failedMap[aid] += 1
+	// once the target is known, a dumped msg is replayed there
+	r.Queue, r.Type, r.Msg = queue, msgType, s
 
-	// resubmit three times or dump
-	if failedMap[aid] > 3 {
-		c.Info.Println("Msg failed three times, dumping!")
-		dumpMsg(msg)
-		return
+	data, err := lib.CritsDataOf([]byte(s), msgType)
+	if err != nil {
+		r.Reason = "no crits data: " + err.Error()
+		return nil, r
 	}
+	r.AnalysisId = data.AnalysisId
 
-	time.Sleep(time.Second * 60)
-	err = resubmit(failed, msg)
+	body, env, err := lib.Resubmission([]byte(s), msgType)
 	if err != nil {
-		c.Info.Println("Resubmiting failed!", err)
-		dumpMsg(msg)
-		return
+		r.Reason = "undecodable msg: " + err.Error()
+		return nil, r
 	}
+	r.CreatedAt = env.CreatedAt
 
-	msg.Ack(false)
-}
+	// the header survives messages without an envelope
+	attempt := env.Attempt
+	if a := lib.AttemptOf(msg); a >= attempt {
+		attempt = a + 1
+	}
 
-func resubmit(failed *lib.FailedMsg, msg *amqp.Delivery) error {
-	s, err := strconv.Unquote(failed.Msg)
-	if err != nil {
-		s = failed.Msg
+	p := policyFor(failed)
+	if !p.retryable(failed) {
+		r.Reason = fmt.Sprintf("not retryable (%s)", failed.Code)
+		return nil, r
+	}
+
+	if attempt > p.MaxAttempts {
+		r.Reason = fmt.Sprintf("gave up after %d attempts", attempt)
+		return nil, r
 	}
 
+	return &resubmission{queue, body, attempt, p.MaxAttempts, p.delay(attempt)}, r
+}
+
+// resubmit sends body to queue after delay, right away if delay is
+// zero.
+func resubmit(queue string, body []byte, attempt int, delay time.Duration, msg *amqp.Delivery) {
 	mapMutex.Lock()
-	if _, exists := producers[failed.Queue]; !exists {
-		producers[failed.Queue] = c.SetupQueue(failed.Queue)
+	if _, exists := producers[queue]; !exists {
+		producers[queue] = c.SetupQueue(queue)
 	}
+	producer := producers[queue]
 	mapMutex.Unlock()
 
-	fmt.Println(s)
+	c.Debug.Println("Resubmitting to", queue, string(body))
+
+	if delay > 0 {
+		producer = producer.Delayed(delay)
+	}
 
-	producers[failed.Queue].Send([]byte(s))
-	return nil
+	producer.For(c.WithMsg(msg, nil, 0, "")).SendHeaders(body, amqp.Table{lib.AttemptHeader: int32(attempt)})
 }
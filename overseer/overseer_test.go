@@ -0,0 +1,379 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cynexit/cuckoo_distributed/lib"
+	"github.com/streadway/amqp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestBackoffSteps(t *testing.T) {
+	tests := []struct {
+		min, max int
+		want     []time.Duration
+	}{
+		{60, 3600, []time.Duration{60, 120, 240, 480, 960, 1920, 3600}},
+		{60, 480, []time.Duration{60, 120, 240, 480}},
+		{60, 60, []time.Duration{60}},
+		{600, 60, []time.Duration{60}},
+	}
+
+	for _, tt := range tests {
+		got := backoffSteps(tt.min, tt.max)
+		if len(got) != len(tt.want) {
+			t.Errorf("backoffSteps(%d, %d) = %v, want %v seconds", tt.min, tt.max, got, tt.want)
+			continue
+		}
+
+		for i := range got {
+			if got[i] != tt.want[i]*time.Second {
+				t.Errorf("backoffSteps(%d, %d) = %v, want %v seconds", tt.min, tt.max, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestDelayUsesSteps(t *testing.T) {
+	setupPolicies(nil)
+	p := policies[0]
+
+	allowed := make(map[time.Duration]bool)
+	for _, s := range p.steps {
+		allowed[s] = true
+	}
+
+	// every delay needs a queue, a burst of failures may only
+	// create as many queues as there are steps
+	seen := make(map[time.Duration]bool)
+	for attempt := 1; attempt <= 20; attempt++ {
+		for i := 0; i < 1000; i++ {
+			d := p.delay(attempt)
+			if !allowed[d] {
+				t.Fatalf("delay(%d) = %s, not one of %v", attempt, d, p.steps)
+			}
+			seen[d] = true
+		}
+	}
+
+	if len(seen) != len(p.steps) {
+		t.Errorf("delays %v, want all of %v", seen, p.steps)
+	}
+}
+
+func TestDelayWithoutJitter(t *testing.T) {
+	p := &retryPolicy{BackoffMin: 60, BackoffMax: 3600, Jitter: -1}
+	p.steps = backoffSteps(p.BackoffMin, p.BackoffMax)
+
+	want := []time.Duration{60, 120, 240, 480, 960, 1920, 3600, 3600, 3600}
+	for i, w := range want {
+		if d := p.delay(i + 1); d != w*time.Second {
+			t.Errorf("delay(%d) = %s, want %s", i+1, d, w*time.Second)
+		}
+	}
+}
+
+func TestRestartIsDumped(t *testing.T) {
+	setupPolicies([]*retryPolicy{{Code: lib.ErrTaskFailed, MaxAttempts: 2}})
+	core := &lib.Core{}
+	req := &lib.DistributedCuckooReq{CritsData: &lib.CritsData{AnalysisId: "5a1b"}}
+
+	submitted, err := core.NewEnvelope(lib.MsgTypeDistributedCuckoo, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	toFeed := &amqp.Delivery{Body: submitted}
+
+	for cycle := 1; ; cycle++ {
+		// feed_cuckoo hands the task to check_results, which fails
+		// and asks to restart at feed_cuckoo
+		fed, err := core.NextEnvelope(toFeed, lib.MsgTypeFeedCuckoo, &lib.FeedCuckooReq{CritsData: req.CritsData})
+		if err != nil {
+			t.Fatal(err)
+		}
+		toCheck := &amqp.Delivery{Headers: amqp.Table{}, Body: fed}
+		if a := lib.AttemptOf(toFeed); a > 0 {
+			toCheck.Headers[lib.AttemptHeader] = int32(a)
+		}
+
+		restart, err := core.NextEnvelope(toCheck, lib.MsgTypeDistributedCuckoo, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		failed := &lib.FailedMsg{
+			Service:   "check_results",
+			Queue:     "worker/check_results",
+			Msg:       string(fed),
+			Code:      lib.ErrTaskFailed,
+			Retryable: true,
+			Stage:     "feed_cuckoo",
+			Restart:   string(restart),
+		}
+		msg := &amqp.Delivery{Headers: amqp.Table{}, Body: []byte("{}")}
+		if a := lib.AttemptOf(toCheck); a > 0 {
+			msg.Headers[lib.AttemptHeader] = int32(a)
+		}
+
+		next, r := plan(failed, msg)
+		if cycle <= 2 {
+			if next == nil {
+				t.Fatalf("cycle %d: dumped (%s), want a resubmission", cycle, r.Reason)
+			}
+			if next.queue != "worker/feed_cuckoo" || next.attempt != cycle {
+				t.Fatalf("cycle %d: resubmitted to %s with attempt %d", cycle, next.queue, next.attempt)
+			}
+
+			toFeed = &amqp.Delivery{Headers: amqp.Table{lib.AttemptHeader: int32(next.attempt)}, Body: next.body}
+			continue
+		}
+
+		if next != nil {
+			t.Fatalf("cycle %d: resubmitted with attempt %d, want a dump", cycle, next.attempt)
+		}
+		if !strings.HasPrefix(r.Reason, "gave up") || r.Queue != "worker/feed_cuckoo" {
+			t.Errorf("cycle %d: dumped to %s because %s", cycle, r.Queue, r.Reason)
+		}
+		break
+	}
+}
+
+func TestPlanQuotedMsg(t *testing.T) {
+	setupPolicies(nil)
+
+	// older services sent the msg quoted and without an envelope
+	legacy := `{"TaskId": 7, "CuckooURL": "http://cuckoo", "CritsData": {"analysis_id": "5a1b"}}`
+	failed := &lib.FailedMsg{
+		Service:   "check_results",
+		Queue:     "worker/check_results",
+		Msg:       strconv.Quote(legacy),
+		Code:      lib.ErrInternal,
+		Retryable: true,
+	}
+
+	next, r := plan(failed, &amqp.Delivery{Body: []byte("{}")})
+	if next == nil {
+		t.Fatalf("dumped quoted msg: %s", r.Reason)
+	}
+	if next.queue != "worker/check_results" || next.attempt != 1 || r.AnalysisId != "5a1b" {
+		t.Errorf("resubmitted to %s with attempt %d for analysis %q", next.queue, next.attempt, r.AnalysisId)
+	}
+}
+
+func TestRedactedKeepsRecord(t *testing.T) {
+	msg := `{"crits_data": {"api_key": "s3cr3t"}}`
+	r := &dlqRecord{Error: "GET /?api_key=s3cr3t failed", Msg: msg}
+
+	shown := r.redacted()
+	if strings.Contains(shown.Error+shown.Msg, "s3cr3t") {
+		t.Errorf("redacted record still holds the secret: %+v", shown)
+	}
+	if r.Msg != msg {
+		t.Errorf("redacting changed the stored msg to %q", r.Msg)
+	}
+}
+
+func TestIsLoopback(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:9105", true},
+		{"127.1.2.3:9105", true},
+		{"[::1]:9105", true},
+		{"localhost:9105", true},
+		{":9105", false},
+		{"0.0.0.0:9105", false},
+		{"10.0.0.5:9105", false},
+		{"admin.example.com:9105", false},
+		{"127.0.0.1", false},
+	}
+
+	for _, tt := range tests {
+		if got := isLoopback(tt.addr); got != tt.want {
+			t.Errorf("isLoopback(%q) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestAdminAuth(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &admin{users: map[string][]byte{"ops": hash}, unknown: hash}
+	handler := a.auth(func(w http.ResponseWriter, r *http.Request, user string) {})
+
+	tests := []struct {
+		user, password string
+		want           int
+	}{
+		{"ops", "hunter2", http.StatusOK},
+		{"ops", "hunter3", http.StatusUnauthorized},
+		{"ops", "", http.StatusUnauthorized},
+		{"dev", "hunter2", http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(tt.user, tt.password)
+		w := httptest.NewRecorder()
+		handler(w, r)
+
+		if w.Code != tt.want {
+			t.Errorf("%s:%s answered %d, want %d", tt.user, tt.password, w.Code, tt.want)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("GET", "/", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("no credentials answered %d", w.Code)
+	}
+}
+
+func testAlerter(repeatAfter time.Duration, rules ...*alertRule) *alerter {
+	a := &alerter{
+		mutex:       &sync.Mutex{},
+		rules:       rules,
+		repeatAfter: repeatAfter,
+		failures:    make(map[failureKey][]time.Time),
+		firing:      make(map[alertKey]*firing),
+	}
+
+	for _, r := range rules {
+		if w := time.Duration(r.Window) * time.Second; w > a.maxWindow {
+			a.maxWindow = w
+		}
+	}
+
+	return a
+}
+
+// fail records failures of the service which happened ago before now.
+func fail(a *alerter, now time.Time, service, code string, ago ...time.Duration) {
+	k := failureKey{service, code, false}
+	for _, d := range ago {
+		a.failures[k] = append(a.failures[k], now.Add(-d))
+	}
+}
+
+func TestAlertFiresAtThreshold(t *testing.T) {
+	a := testAlerter(time.Hour, &alertRule{Name: "crits", Code: lib.ErrCrits, Window: 300, Threshold: 3})
+	now := time.Now()
+
+	// every service is counted on its own, other codes not at all
+	fail(a, now, "parse_and_submit", lib.ErrCrits, 20*time.Second, 10*time.Second)
+	fail(a, now, "feed_cuckoo", lib.ErrCrits, 10*time.Second)
+	fail(a, now, "parse_and_submit", lib.ErrCuckoo, 10*time.Second, 5*time.Second, time.Second)
+	if alerts := a.due(now); len(alerts) != 0 {
+		t.Fatalf("below the threshold: %s", alerts[0].subject())
+	}
+
+	fail(a, now, "parse_and_submit", lib.ErrCrits, time.Second)
+	alerts := a.due(now)
+	if len(alerts) != 1 {
+		t.Fatalf("at the threshold: %d alerts", len(alerts))
+	}
+
+	al := alerts[0]
+	if al.State != alertFiring || al.Rule != "crits" || al.Service != "parse_and_submit" || al.Code != lib.ErrCrits || al.Count != 3 || !al.Since.Equal(now) {
+		t.Errorf("alert = %+v", al)
+	}
+}
+
+func TestAlertRepeat(t *testing.T) {
+	a := testAlerter(time.Hour, &alertRule{Window: 300, Threshold: 1})
+	start := time.Now()
+
+	for _, tt := range []struct {
+		after time.Duration
+		sent  bool
+	}{
+		{0, true},
+		{time.Minute, false},
+		{59 * time.Minute, false},
+		{time.Hour, true},
+		{time.Hour + time.Minute, false},
+	} {
+		now := start.Add(tt.after)
+		fail(a, now, "check_results", lib.ErrCuckoo, time.Second)
+
+		alerts := a.due(now)
+		if sent := len(alerts) > 0; sent != tt.sent {
+			t.Fatalf("after %s: sent %v, want %v", tt.after, sent, tt.sent)
+		}
+		if tt.sent && (alerts[0].State != alertFiring || !alerts[0].Since.Equal(start)) {
+			t.Errorf("after %s: alert = %+v", tt.after, alerts[0])
+		}
+	}
+}
+
+func TestAlertNeverRepeated(t *testing.T) {
+	a := testAlerter(-1, &alertRule{Window: 300, Threshold: 1})
+	start := time.Now()
+
+	for i := 0; i < 5; i++ {
+		now := start.Add(time.Duration(i) * 24 * time.Hour)
+		fail(a, now, "check_results", lib.ErrCuckoo, time.Second)
+
+		want := 0
+		if i == 0 {
+			want = 1
+		}
+		if alerts := a.due(now); len(alerts) != want {
+			t.Fatalf("after %d days: %d alerts, want %d", i, len(alerts), want)
+		}
+	}
+}
+
+func TestAlertResolved(t *testing.T) {
+	a := testAlerter(time.Hour, &alertRule{Window: 300, Threshold: 2})
+	start := time.Now()
+
+	fail(a, start, "feed_cuckoo", lib.ErrCuckoo, 20*time.Second, 10*time.Second)
+	if alerts := a.due(start); len(alerts) != 1 {
+		t.Fatalf("%d alerts fired", len(alerts))
+	}
+
+	// one failure left in the window
+	now := start.Add(285 * time.Second)
+	alerts := a.due(now)
+	if len(alerts) != 1 {
+		t.Fatalf("%d alerts once below the threshold", len(alerts))
+	}
+
+	al := alerts[0]
+	if al.State != alertResolved || al.Count != 1 || !al.Since.Equal(start) || !al.At.Equal(now) {
+		t.Errorf("alert = %+v", al)
+	}
+
+	if alerts := a.due(now.Add(time.Minute)); len(alerts) != 0 {
+		t.Errorf("resolved again: %s", alerts[0].subject())
+	}
+}
+
+func TestAlertPruning(t *testing.T) {
+	a := testAlerter(time.Hour, &alertRule{Window: 60, Threshold: 100}, &alertRule{Window: 300, Threshold: 100})
+	now := time.Now()
+
+	fail(a, now, "feed_cuckoo", lib.ErrCuckoo, 400*time.Second, 200*time.Second, 10*time.Second)
+	fail(a, now, "check_results", lib.ErrCuckoo, 600*time.Second, 301*time.Second)
+	a.due(now)
+
+	kept := a.failures[failureKey{"feed_cuckoo", lib.ErrCuckoo, false}]
+	if len(kept) != 2 || !kept[0].Equal(now.Add(-200*time.Second)) {
+		t.Errorf("kept %v of feed_cuckoo", kept)
+	}
+
+	if _, exists := a.failures[failureKey{"check_results", lib.ErrCuckoo, false}]; exists {
+		t.Errorf("kept failures outside every window")
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"net"
+
+	"git.sec.in.tum.de/cvp/distributed-cuckoo/lib"
+)
+
+// indicatorsConfig configures the indicators parser which creates
+// crits indicators, domains, and ips from the report.
+type indicatorsConfig struct {
+	Source     string   // empty to use the source of the sample
+	Method     string   // e.g. "cuckoo"
+	Reference  string   // reference added to every object
+	Confidence string   // low, medium, high, or unknown
+	Impact     string   // low, medium, high, or unknown
+	Types      []string // any of "domain", "ip", "mutex", "md5"; empty for all
+}
+
+// iocRelTypes contains the relationship between the analysed
+// sample and the objects created for each kind of IOC.
+var iocRelTypes = map[string]string{
+	"domain": "Connected To",
+	"ip":     "Connected To",
+	"mutex":  "Created",
+	"md5":    "Dropped",
+}
+
+// ioc is a single indicator found in the report.
+type ioc struct {
+	kind  string // domain, ip, mutex, or md5
+	value string
+}
+
+// processIndicators creates crits objects for all contacted domains
+// and ips, mutexes, and dropped file hashes found in the report and
+// relates them to the analysed sample. IOCs created by an earlier
+// try of the same analysis are skipped.
+func processIndicators(report *lib.CkoTasksReport, ctx *lib.ParserContext) ([]*lib.CrtResult, error) {
+	crits := ctx.Crits
+	results := []*lib.CrtResult{}
+
+	opts := &lib.CrtObjectOpts{
+		Source:     indicators.Source,
+		Method:     indicators.Method,
+		Reference:  indicators.Reference,
+		Confidence: indicators.Confidence,
+		Impact:     indicators.Impact,
+	}
+
+	for _, i := range collectIOCs(report) {
+		resMap := make(map[string]interface{})
+		resMap["type"] = i.kind
+
+		step := fmt.Sprintf("indicator/%s/%s", i.kind, i.value)
+		if id, done := ctx.Done(step); done {
+			resMap["indicator_id"] = id
+			results = append(results, &lib.CrtResult{
+				"indicator",
+				i.value,
+				resMap,
+			})
+			continue
+		}
+
+		ids, err := createIOC(i, crits, opts)
+		if err != nil {
+			return results, err
+		}
+
+		for objType, id := range ids {
+			err = crits.ForgeRelationship(&lib.CrtRelationship{
+				RightType:  objType,
+				RightId:    id,
+				RelType:    iocRelTypes[i.kind],
+				Confidence: indicators.Confidence,
+				Reason:     "Observed during cuckoo analysis",
+			})
+			if err != nil {
+				return results, err
+			}
+		}
+
+		ctx.MarkDone(step, ids["Indicator"])
+
+		resMap["indicator_id"] = ids["Indicator"]
+
+		results = append(results, &lib.CrtResult{
+			"indicator",
+			i.value,
+			resMap,
+		})
+	}
+
+	return results, nil
+}
+
+// createIOC creates the indicator and, for domains and ips, the
+// domain or ip object. It returns the ids keyed by object type.
+func createIOC(i *ioc, crits *lib.CritsConn, opts *lib.CrtObjectOpts) (map[string]string, error) {
+	ids := make(map[string]string)
+
+	indType := ""
+	switch i.kind {
+	case "domain":
+		indType = "Domain"
+
+		id, err := crits.NewDomain(i.value, opts)
+		if err != nil {
+			return nil, err
+		}
+		ids["Domain"] = id
+
+	case "ip":
+		indType = "IPv4 Address"
+		if net.ParseIP(i.value).To4() == nil {
+			indType = "IPv6 Address"
+		}
+
+		id, err := crits.NewIP(i.value, indType, opts)
+		if err != nil {
+			return nil, err
+		}
+		ids["IP"] = id
+
+	case "mutex":
+		indType = "Mutex"
+
+	case "md5":
+		indType = "MD5"
+	}
+
+	id, err := crits.NewIndicator(indType, i.value, opts)
+	if err != nil {
+		return nil, err
+	}
+	ids["Indicator"] = id
+
+	return ids, nil
+}
+
+// collectIOCs returns all unique IOCs of the enabled types.
+func collectIOCs(report *lib.CkoTasksReport) []*ioc {
+	enabled := make(map[string]bool)
+	for _, t := range indicators.Types {
+		enabled[t] = true
+	}
+
+	iocs := []*ioc{}
+	seen := make(map[ioc]bool)
+	add := func(kind, value string) {
+		i := ioc{kind, value}
+		if value == "" || seen[i] || (len(enabled) > 0 && !enabled[kind]) {
+			return
+		}
+
+		seen[i] = true
+		iocs = append(iocs, &i)
+	}
+
+	if report.Network != nil {
+		for _, d := range report.Network.Domains {
+			add("domain", d.Domain)
+		}
+
+		for _, h := range report.Network.Hosts {
+			if ip := net.ParseIP(string(h)); ip != nil && isPublicIP(ip) {
+				add("ip", string(h))
+			}
+		}
+	}
+
+	if report.Behavior != nil && report.Behavior.Summary != nil {
+		for _, m := range report.Behavior.Summary.Mutexes {
+			add("mutex", m)
+		}
+	}
+
+	for _, f := range report.Dropped {
+		add("md5", f.MD5)
+	}
+
+	return iocs
+}
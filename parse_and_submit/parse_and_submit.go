@@ -6,13 +6,16 @@ import (
 	"compress/bzip2"
 	"crypto/md5"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"git.sec.in.tum.de/cvp/distributed-cuckoo/lib"
@@ -29,8 +32,39 @@ type config struct {
 	PushApiCallsMax int
 	CuckooCleanup   bool
 	EnabledParsers  []string
+	AttackMapping   string
+	Verdict         *verdictConfig
+	Indicators      *indicatorsConfig
+	Tagging         *taggingConfig
+	ChunkResults    int
+	ChunkBytes      int
+	CritsRateLimit  *lib.RateLimitConfig
+	Credentials     *lib.CredentialsConfig
+	AllowedCrits    []string
+	AllowedCuckoos  []string
+	LedgerDir       string
+	LedgerMaxAge    int
+	HTTP            *lib.HTTPConfig
+	MonitorAddr     string
+	Tracing         *lib.TraceConfig
+	Security        *lib.SecurityConfig
 	LogFile         string
 	LogLevel        string
+	LogFormat       string
+	LogMaxSize      int
+	LogMaxBackups   int
+}
+
+// verdictConfig holds the weights and thresholds used to
+// compute the verdict of an analysis.
+type verdictConfig struct {
+	Severity          float64           // per severity point of every signature
+	Yara              float64           // per yara hit on the sample or dropped files
+	NetworkIOC        float64           // per contacted public host or domain
+	DroppedExecutable float64           // per dropped executable
+	Suspicious        float64           // minimum score for "suspicious"
+	Malicious         float64           // minimum score for "malicious"
+	Buckets           map[string]string // bucket added to the sample by verdict, none by default
 }
 
 type critsForgeRelReq struct {
@@ -48,12 +82,42 @@ type critsServicesResp struct {
 	Type       string `json:"type"`
 }
 
+// signatureEvidenceMax is the maximum number of marks sent
+// to crits for a single signature.
+const signatureEvidenceMax = 20
+
 var (
 	c               *lib.Core
 	producer        *lib.QueueHandler
 	cuckooCleanup   bool
 	pushApiCallsMax int
-	enabledParsers  = make(map[string]bool)
+	chunkResults    = lib.DefaultChunkResults
+	chunkBytes      = lib.DefaultChunkBytes
+	parsers         []lib.Parser
+	attackMapping   *lib.AttackMapping
+	indicators      = &indicatorsConfig{
+		Method:     "cuckoo",
+		Confidence: "unknown",
+		Impact:     "unknown",
+	}
+	tagging = &taggingConfig{
+		CampaignConfidence: "unknown",
+	}
+	// decoding into the default rules would merge them with the
+	// configured ones, they are only used if no rules are set.
+	defaultTagRules = []*tagRule{
+		&tagRule{Subtype: "malware_family", Bucket: "%s"},
+		&tagRule{Subtype: "verdict", Result: "malicious", Bucket: "malicious"},
+		&tagRule{Subtype: "verdict", Result: "suspicious", Bucket: "suspicious"},
+	}
+	verdict = &verdictConfig{
+		Severity:          1,
+		Yara:              3,
+		NetworkIOC:        0.5,
+		DroppedExecutable: 2,
+		Suspicious:        4,
+		Malicious:         10,
+	}
 )
 
 func main() {
@@ -66,7 +130,8 @@ func main() {
 		confPath += "/parse_and_submit.conf.json"
 	}
 
-	conf := &config{}
+	// options missing in the config file keep their defaults
+	conf := &config{Verdict: verdict, Indicators: indicators, Tagging: tagging}
 	cfile, _ := os.Open(confPath)
 	decoder := json.NewDecoder(cfile)
 	err := decoder.Decode(&conf)
@@ -75,43 +140,141 @@ func main() {
 	}
 
 	// setup
-	c = lib.Init("parse_and_submit", conf.Amqp, conf.LogFile, conf.LogLevel, conf.FailedQueue, conf.VerifySSL)
+	c = lib.Init("parse_and_submit", conf.Amqp, &lib.LogConfig{conf.LogFile, conf.LogLevel, conf.LogFormat, conf.LogMaxSize, conf.LogMaxBackups}, conf.FailedQueue, conf.VerifySSL)
+	c.SetupTracing(conf.Tracing)
+	c.SetupSecurity(conf.Security)
+	c.SetupHTTP(conf.HTTP)
+	c.AddReadyCheck("crits", checkCrits)
+	c.StartMonitor(conf.MonitorAddr)
+	c.SetupRateLimit(conf.CritsRateLimit)
+	c.SetupCredentials(conf.Credentials)
+	c.AllowCritsURLs(conf.AllowedCrits)
+	c.AllowCuckooURLs(conf.AllowedCuckoos)
 	pushApiCallsMax = conf.PushApiCallsMax
 	cuckooCleanup = conf.CuckooCleanup
 
+	if conf.Verdict != nil {
+		verdict = conf.Verdict
+	}
+
+	if conf.Indicators != nil {
+		indicators = conf.Indicators
+	}
+
+	if conf.Tagging != nil {
+		tagging = conf.Tagging
+	}
+	if tagging.Rules == nil {
+		tagging.Rules = defaultTagRules
+	}
+
+	if conf.ChunkResults > 0 {
+		chunkResults = conf.ChunkResults
+	}
+
+	if conf.ChunkBytes > 0 {
+		chunkBytes = conf.ChunkBytes
+	}
+
+	c.Ledger = c.OpenLedger(conf.LedgerDir)
+	if c.Ledger != nil {
+		maxAge := conf.LedgerMaxAge
+		if maxAge <= 0 {
+			maxAge = 7 * 24
+		}
+
+		go expireLedger(time.Hour * time.Duration(maxAge))
+	}
+
 	if conf.ProducerQueue != "" {
 		producer = c.SetupQueue(conf.ProducerQueue)
 	}
 
-	for _, e := range conf.EnabledParsers {
-		enabledParsers[e] = true
+	parsers, err = lib.SelectParsers(conf.EnabledParsers)
+	c.FailOnError(err, "Invalid EnabledParsers!")
+
+	if parserEnabled("attack") {
+		if conf.AttackMapping == "" {
+			conf.AttackMapping, _ = filepath.Abs(filepath.Dir(os.Args[0]))
+			conf.AttackMapping += "/attack_mapping.json"
+		}
+
+		attackMapping, err = lib.LoadAttackMapping(conf.AttackMapping)
+		c.FailOnError(err, "Could not load the ATT&CK mapping!")
 	}
 
 	c.Consume(conf.ConsumerQueue, conf.PrefetchCount, parseMsg)
 }
 
+// expireLedger removes old entries from the ledger once an hour.
+func expireLedger(maxAge time.Duration) {
+	for {
+		removed, err := c.Ledger.Expire(maxAge)
+		if err != nil {
+			c.Warning.Println("Expiring the ledger failed!", err)
+		} else if removed > 0 {
+			c.Debug.Printf("Removed %d old entries from the ledger\n", removed)
+		}
+
+		time.Sleep(time.Hour)
+	}
+}
+
+// checkCrits checks if all crits instances which sent us work so
+// far are reachable.
+func checkCrits() (interface{}, error) {
+	states := make(map[string]string)
+	failed := 0
+
+	for _, URL := range c.CritsURLs() {
+		states[URL] = "ok"
+		if err := c.Reachable(URL); err != nil {
+			states[URL] = err.Error()
+			failed += 1
+		}
+	}
+
+	if failed > 0 {
+		return states, errors.New(fmt.Sprintf("%d of %d crits instances unreachable", failed, len(states)))
+	}
+
+	return states, nil
+}
+
+// parserEnabled checks if the parser with the given name is enabled.
+func parserEnabled(name string) bool {
+	for _, p := range parsers {
+		if p.Name() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
 // parseMsg accepts an *amqp.Delivery and parses the body assuming
 // it's a request from check_results.
 func parseMsg(msg amqp.Delivery) {
 	m := &lib.CheckResultsReq{}
-	err := json.Unmarshal(msg.Body, m)
-	if c.NackOnError(err, "Could not decode json!", &msg) {
+	_, err := lib.OpenEnvelope(msg.Body, lib.MsgTypeCheckResults, m)
+	if c.NackWithCode(err, lib.ErrMalformed, "Could not decode msg!", &msg) {
 		return
 	}
 
-	if c.NackOnError(m.Validate(), "Error in msg from check_results service!", &msg) {
+	if c.NackWithCode(m.Validate(), lib.ErrMalformed, "Error in msg from check_results service!", &msg) {
 		return
 	}
 
-	// number of threads (and therby concurrent connections to crits)
-	// can be indirectly controled by the PrefetchCount param in the
-	// config file.
+	// number of threads can be indirectly controled by the
+	// PrefetchCount param in the config file, the connections
+	// to crits are limited by CritsRateLimit.
 	go reportToCrits(m, &msg)
 	return
 }
 
 func reportToCrits(m *lib.CheckResultsReq, msg *amqp.Delivery) {
 	start := time.Now()
+	c := c.WithMsg(msg, m.CritsData, m.TaskId, m.CuckooURL)
 
 	// there is a chance that we get this far
 	// when cuckoo is done with the job but still
@@ -120,47 +283,52 @@ func reportToCrits(m *lib.CheckResultsReq, msg *amqp.Delivery) {
 
 	// TODO: check if an invalid machine was specified -> no results
 
-	crits := c.NewCrits(m.CritsData)
-	cuckoo := c.NewCuckoo(m.CuckooURL)
-
-	report, err := cuckoo.TaskReport(m.TaskId)
-	if c.NackOnError(err, "Couldn't load report from cuckoo!", msg) {
+	crits, err := c.NewCrits(m.CritsData)
+	if c.NackWithCode(err, lib.ErrNotAllowed, "Message references an unknown crits instance or user!", msg) {
 		return
 	}
+	crits.ChunkResults = chunkResults
+	crits.ChunkBytes = chunkBytes
 
-	resStructs := []*lib.CrtResult{}
-	isSet := false
-
-	// info
-	if _, isSet = enabledParsers["info"]; isSet {
-		resStructs = processReportInfo(report.Info)
-	}
-
-	// signatures
-	if _, isSet = enabledParsers["signatures"]; isSet {
-		resStructs = append(resStructs, processReportSignatures(report.Signatures)...)
+	cuckoo, err := c.NewCuckoo(m.CuckooURL)
+	if c.NackWithCode(err, lib.ErrNotAllowed, "Message references a cuckoo instance which is not allowed!", msg) {
+		return
 	}
 
-	// behavior
-	if _, isSet = enabledParsers["behavior"]; isSet {
-		resStructs = append(resStructs, processReportBehavior(report.Behavior)...)
+	// only download the report if a parser actually needs it
+	// and only decode the sections the enabled parsers use.
+	report := &lib.CkoTasksReport{}
+	if sections := lib.ReportSections(parsers); len(sections) > 0 {
+		report, err = cuckoo.TaskReport(m.TaskId, &lib.CkoReportOpts{
+			Sections: sections,
+			MaxCalls: pushApiCallsMax,
+		})
+		if c.NackWithCode(err, lib.ErrCuckoo, "Couldn't load report from cuckoo!", msg) {
+			return
+		}
 	}
 
-	// dropped files
-	if _, isSet = enabledParsers["dropped"]; isSet {
-		dResStructs, err := processDropped(m, cuckoo, crits)
-		//if c.NackOnError(err, "processDropped failed", msg) {
-		//	return
-		//}
-		if err != nil {
-			c.Warning.Println("processDropped () exited with", err, "after dropping", len(dResStructs))
+	// the results of each parser are sent to crits as soon as
+	// it's done. On a retry results which were already added
+	// are skipped.
+	_, err = lib.RunParsers(parsers, report, &lib.ParserContext{
+		C:      c,
+		Req:    m,
+		Cuckoo: cuckoo,
+		Crits:  crits,
+	})
+	if pe, parseFailed := err.(*lib.ParserError); parseFailed {
+		// a report a parser can't make sense of won't change,
+		// other failures may be gone on the next try.
+		code := lib.ErrTaskFailed
+		if pe.Fatal {
+			code = lib.ErrMalformed
 		}
-		resStructs = append(resStructs, dResStructs...)
-	}
 
-	// parsing is done
-	err = crits.AddResults(resStructs)
-	if c.NackOnError(err, "Adding results to crits failed!", msg) {
+		c.NackWithCode(err, code, "Parsing the report failed!", msg)
+		return
+	}
+	if c.NackWithCode(err, lib.ErrCrits, "Adding the results to crits failed!", msg) {
 		return
 	}
 
@@ -171,14 +339,12 @@ func reportToCrits(m *lib.CheckResultsReq, msg *amqp.Delivery) {
 	}
 
 	if producer != nil {
-		producer.Send(msg.Body)
+		producer.For(c).Forward(msg.Body, msg)
 	}
 
 	elapsed := time.Since(start)
 	c.Info.Printf("Finished object %s [cuckoo: %d] in %s \n", m.CritsData.ObjectId, m.TaskId, elapsed)
-	if err := msg.Ack(false); err != nil {
-		c.Warning.Println("Sending ACK failed!", err.Error())
-	}
+	c.Ack(msg)
 }
 
 // processReportInfo extracts all the data from the info
@@ -211,30 +377,187 @@ func processReportInfo(i *lib.CkoTasksReportInfo) []*lib.CrtResult {
 }
 
 // processReportSignatures extracts all the data from the signatures
-// section of the cuckoo report struct.
+// section of the cuckoo report struct. Every malware family named by
+// a signature is added as an additional malware_family result.
 func processReportSignatures(sigs []*lib.CkoTasksReportSignature) []*lib.CrtResult {
 	if sigs == nil {
 		return []*lib.CrtResult{}
 	}
 
-	l := len(sigs)
-	res := make([]*lib.CrtResult, l, l)
-	resMap := make(map[string]interface{})
+	res := []*lib.CrtResult{}
+	families := []*lib.CrtResult{}
+	seenFamilies := make(map[string]bool)
 
-	for k, sig := range sigs {
+	for _, sig := range sigs {
+		resMap := make(map[string]interface{})
 		resMap["severity"] = strconv.Itoa(sig.Severity)
 		resMap["name"] = sig.Name
 
-		res[k] = &lib.CrtResult{
+		if len(sig.Families) > 0 {
+			resMap["families"] = strings.Join(sig.Families, ", ")
+		}
+
+		if len(sig.References) > 0 {
+			resMap["references"] = sig.References
+		}
+
+		if ttps := sig.TTPIds(); len(ttps) > 0 {
+			resMap["ttp"] = strings.Join(ttps, ", ")
+		}
+
+		// crits evaluates the result data with ast so every mark
+		// is passed on as json string instead of nested values.
+		evidence := sig.Evidence()
+		if len(evidence) > 0 {
+			marks := []string{}
+			for i, e := range evidence {
+				if i >= signatureEvidenceMax {
+					break
+				}
+				marks = append(marks, string(e))
+			}
+
+			resMap["evidence"] = marks
+			resMap["evidence_count"] = strconv.Itoa(len(evidence))
+		}
+
+		res = append(res, &lib.CrtResult{
 			"signature",
 			sig.Description,
 			resMap,
+		})
+
+		for _, f := range sig.Families {
+			if seenFamilies[strings.ToLower(f)] {
+				continue
+			}
+			seenFamilies[strings.ToLower(f)] = true
+
+			families = append(families, &lib.CrtResult{
+				"malware_family",
+				f,
+				map[string]interface{}{"signature": sig.Name},
+			})
+		}
+	}
+
+	return append(res, families...)
+}
+
+// processAttackTechniques maps the signatures to ATT&CK techniques and
+// returns one result per technique and triggering signature.
+func processAttackTechniques(sigs []*lib.CkoTasksReportSignature) []*lib.CrtResult {
+	res := []*lib.CrtResult{}
+	warned := false
+
+	for _, sig := range sigs {
+		techniques, err := attackMapping.Lookup(sig)
+		if err != nil && !warned {
+			c.Warning.Println("Reloading the ATT&CK mapping failed, using the old one:", err)
+			warned = true
+		}
+
+		for _, t := range techniques {
+			resMap := make(map[string]interface{})
+			resMap["signature"] = sig.Name
+			resMap["technique"] = t.Name
+			resMap["tactic"] = strings.Join(t.Tactics, ", ")
+
+			res = append(res, &lib.CrtResult{
+				"attack_technique",
+				t.Id,
+				resMap,
+			})
 		}
 	}
 
 	return res
 }
 
+// processVerdict computes a score from signature severities, yara
+// hits, network IOCs and dropped executables and turns it into a
+// clean / suspicious / malicious verdict.
+func processVerdict(report *lib.CkoTasksReport) *lib.CrtResult {
+	score := 0.0
+	factors := []string{}
+
+	addFactor := func(name string, count int, weight float64) {
+		if count == 0 || weight == 0 {
+			return
+		}
+
+		points := float64(count) * weight
+		score += points
+		factors = append(factors, fmt.Sprintf("%s: %d x %.1f = %.1f", name, count, weight, points))
+	}
+
+	severity := 0
+	for _, sig := range report.Signatures {
+		severity += sig.Severity
+	}
+	addFactor("signature severity", severity, verdict.Severity)
+
+	yara := 0
+	if report.Target != nil && report.Target.File != nil {
+		yara += len(report.Target.File.Yara)
+	}
+	for _, f := range report.Dropped {
+		yara += len(f.Yara)
+	}
+	addFactor("yara hits", yara, verdict.Yara)
+
+	iocs := make(map[string]bool)
+	if report.Network != nil {
+		for _, h := range report.Network.Hosts {
+			if ip := net.ParseIP(string(h)); ip != nil && isPublicIP(ip) {
+				iocs[string(h)] = true
+			}
+		}
+
+		for _, d := range report.Network.Domains {
+			if d.Domain != "" {
+				iocs[d.Domain] = true
+			}
+		}
+	}
+	addFactor("network iocs", len(iocs), verdict.NetworkIOC)
+
+	executables := 0
+	for _, f := range report.Dropped {
+		if f.IsExecutable() {
+			executables += 1
+		}
+	}
+	addFactor("dropped executables", executables, verdict.DroppedExecutable)
+
+	label := "clean"
+	if score >= verdict.Malicious {
+		label = "malicious"
+	} else if score >= verdict.Suspicious {
+		label = "suspicious"
+	}
+
+	resMap := make(map[string]interface{})
+	resMap["score"] = fmt.Sprintf("%.1f", score)
+	resMap["factors"] = factors
+
+	return &lib.CrtResult{
+		"verdict",
+		label,
+		resMap,
+	}
+}
+
+// isPublicIP filters out all the hosts every analysis contacts,
+// like the local network or multicast addresses.
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsMulticast() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsPrivate() {
+		return false
+	}
+
+	return !ip.Equal(net.IPv4bcast)
+}
+
 // processReportBehavior extracts all the data from the behavior
 // section of the cuckoo report struct.
 func processReportBehavior(behavior *lib.CkoTasksReportBehavior) []*lib.CrtResult {
@@ -328,8 +651,12 @@ func processReportBehavior(behavior *lib.CkoTasksReportBehavior) []*lib.CrtResul
 	return res
 }
 
-func processDropped(m *lib.CheckResultsReq, cuckoo *lib.CuckooConn, crits *lib.CritsConn) ([]*lib.CrtResult, error) {
+// processDropped uploads all dropped files to crits and relates
+// them to the analysed sample. Files uploaded by an earlier try of
+// the same analysis are skipped.
+func processDropped(ctx *lib.ParserContext) ([]*lib.CrtResult, error) {
 	start := time.Now()
+	m, cuckoo, crits := ctx.Req, ctx.Cuckoo, ctx.Crits
 
 	resp, err := cuckoo.GetDropped(m.TaskId)
 	if err != nil {
@@ -360,13 +687,24 @@ func processDropped(m *lib.CheckResultsReq, cuckoo *lib.CuckooConn, crits *lib.C
 
 		name := filepath.Base(hdr.Name)
 		fileData, err := ioutil.ReadAll(untar)
+		if err != nil {
+			return results, err
+		}
 
-		id, err := crits.NewSample(fileData, name)
+		resMap := make(map[string]interface{})
+		resMap["md5"] = fmt.Sprintf("%x", md5.Sum(fileData))
 
-		// we need to add a short sleep here so tastypie won't crash.
-		// this is a very ugly work around but sadly necessary
-		time.Sleep(time.Second * 1)
+		step := fmt.Sprintf("dropped/%s/%s", resMap["md5"], name)
+		if _, done := ctx.Done(step); done {
+			results = append(results, &lib.CrtResult{
+				"file_added",
+				name,
+				resMap,
+			})
+			continue
+		}
 
+		id, err := crits.NewSample(fileData, name)
 		if err != nil {
 			if err.Error() == "empty file" {
 				continue
@@ -375,15 +713,19 @@ func processDropped(m *lib.CheckResultsReq, cuckoo *lib.CuckooConn, crits *lib.C
 			return results, err
 		}
 
-		if err = crits.ForgeRelationship(id); err != nil {
+		err = crits.ForgeRelationship(&lib.CrtRelationship{
+			LeftType:  "Sample",
+			LeftId:    id,
+			RightType: m.CritsData.ObjectType,
+			RightId:   m.CritsData.ObjectId,
+			RelType:   "Dropped By",
+			Reason:    fmt.Sprintf("Dropped during cuckoo analysis %d", m.TaskId),
+		})
+		if err != nil {
 			return results, err
 		}
 
-		// see comment above
-		time.Sleep(time.Second * 1)
-
-		resMap := make(map[string]interface{})
-		resMap["md5"] = fmt.Sprintf("%x", md5.Sum(fileData))
+		ctx.MarkDone(step, id)
 
 		results = append(results, &lib.CrtResult{
 			"file_added",
@@ -393,7 +735,7 @@ func processDropped(m *lib.CheckResultsReq, cuckoo *lib.CuckooConn, crits *lib.C
 	}
 
 	elapsed := time.Since(start)
-	c.Debug.Printf("Uploaded %d dropped files in %s [%s]\n", len(results), elapsed, m.CritsData.AnalysisId)
+	ctx.C.Debug.Printf("Uploaded %d dropped files in %s [%s]\n", len(results), elapsed, m.CritsData.AnalysisId)
 
 	return results, nil
 }
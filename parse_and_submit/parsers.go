@@ -0,0 +1,127 @@
+package main
+
+import (
+	"git.sec.in.tum.de/cvp/distributed-cuckoo/lib"
+)
+
+// All parsers shipped with parse_and_submit. They are selected
+// by name via the EnabledParsers option.
+func init() {
+	lib.RegisterParser(verdictParser{})
+	lib.RegisterParser(infoParser{})
+	lib.RegisterParser(signaturesParser{})
+	lib.RegisterParser(attackParser{})
+	lib.RegisterParser(behaviorParser{})
+	lib.RegisterParser(droppedParser{})
+	lib.RegisterParser(indicatorsParser{})
+	lib.RegisterParser(taggingParser{})
+}
+
+// verdictParser computes the verdict of the analysis. It runs
+// first so the verdict is the first result shown in crits.
+type verdictParser struct{}
+
+func (verdictParser) Name() string { return "verdict" }
+func (verdictParser) Order() int   { return -100 }
+
+func (verdictParser) Sections() []string {
+	return []string{"signatures", "target", "network", "dropped"}
+}
+
+func (verdictParser) Parse(report *lib.CkoTasksReport, ctx *lib.ParserContext) ([]*lib.CrtResult, error) {
+	res := processVerdict(report)
+
+	if bucket := verdict.Buckets[res.Result]; bucket != "" {
+		if _, done := ctx.Done("verdict/bucket"); !done {
+			if err := ctx.Crits.AddBuckets([]string{bucket}); err != nil {
+				return []*lib.CrtResult{res}, err
+			}
+			ctx.MarkDone("verdict/bucket", bucket)
+		}
+	}
+
+	return []*lib.CrtResult{res}, nil
+}
+
+type infoParser struct{}
+
+func (infoParser) Name() string       { return "info" }
+func (infoParser) Sections() []string { return []string{"info"} }
+
+func (infoParser) Parse(report *lib.CkoTasksReport, ctx *lib.ParserContext) ([]*lib.CrtResult, error) {
+	return processReportInfo(report.Info), nil
+}
+
+type signaturesParser struct{}
+
+func (signaturesParser) Name() string       { return "signatures" }
+func (signaturesParser) Sections() []string { return []string{"signatures"} }
+
+func (signaturesParser) Parse(report *lib.CkoTasksReport, ctx *lib.ParserContext) ([]*lib.CrtResult, error) {
+	return processReportSignatures(report.Signatures), nil
+}
+
+// attackParser maps signatures to MITRE ATT&CK techniques using
+// the mapping file set by the AttackMapping option.
+type attackParser struct{}
+
+func (attackParser) Name() string       { return "attack" }
+func (attackParser) Sections() []string { return []string{"signatures"} }
+
+func (attackParser) Parse(report *lib.CkoTasksReport, ctx *lib.ParserContext) ([]*lib.CrtResult, error) {
+	return processAttackTechniques(report.Signatures), nil
+}
+
+type behaviorParser struct{}
+
+func (behaviorParser) Name() string       { return "behavior" }
+func (behaviorParser) Sections() []string { return []string{"behavior", "behavior.calls"} }
+
+func (behaviorParser) Parse(report *lib.CkoTasksReport, ctx *lib.ParserContext) ([]*lib.CrtResult, error) {
+	return processReportBehavior(report.Behavior), nil
+}
+
+// droppedParser doesn't use the report but downloads the dropped
+// files from cuckoo and uploads them to crits.
+type droppedParser struct{}
+
+func (droppedParser) Name() string       { return "dropped" }
+func (droppedParser) Sections() []string { return nil }
+
+func (droppedParser) Parse(report *lib.CkoTasksReport, ctx *lib.ParserContext) ([]*lib.CrtResult, error) {
+	// nobody else uses the results so there is no need to
+	// download the files again if they were already added.
+	if _, done := ctx.Done("results/dropped"); done {
+		return []*lib.CrtResult{}, nil
+	}
+
+	return processDropped(ctx)
+}
+
+// indicatorsParser creates crits indicators, domains, and ips for
+// the IOCs found in the report. It is slow and only runs if it is
+// explicitly enabled.
+type indicatorsParser struct{}
+
+func (indicatorsParser) Name() string { return "indicators" }
+
+func (indicatorsParser) Sections() []string {
+	return []string{"network", "behavior", "dropped"}
+}
+
+func (indicatorsParser) Parse(report *lib.CkoTasksReport, ctx *lib.ParserContext) ([]*lib.CrtResult, error) {
+	return processIndicators(report, ctx)
+}
+
+// taggingParser writes buckets, ticket, campaign, and status back
+// to the sample. The buckets are derived from the results of the
+// other parsers so it runs last.
+type taggingParser struct{}
+
+func (taggingParser) Name() string       { return "tagging" }
+func (taggingParser) Order() int         { return 100 }
+func (taggingParser) Sections() []string { return nil }
+
+func (taggingParser) Parse(report *lib.CkoTasksReport, ctx *lib.ParserContext) ([]*lib.CrtResult, error) {
+	return processTagging(ctx)
+}
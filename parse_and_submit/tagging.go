@@ -0,0 +1,135 @@
+package main
+
+import (
+	"path"
+	"strings"
+
+	"git.sec.in.tum.de/cvp/distributed-cuckoo/lib"
+)
+
+// taggingConfig configures what the tagging parser writes back
+// to the analysed sample besides the results.
+type taggingConfig struct {
+	Rules              []*tagRule
+	Ticket             string // ticket added to every sample
+	Campaign           string // campaign every sample is attributed to
+	CampaignConfidence string // low, medium, high, or unknown
+	Status             string // status set after the analysis, e.g. "Analyzed"
+}
+
+// tagRule adds a bucket to the sample for every result with the
+// given subtype whose result matches the pattern.
+type tagRule struct {
+	Subtype string // e.g. "malware_family" or "verdict"
+	Result  string // pattern as used by path.Match, empty matches everything
+	Bucket  string // bucket to add, %s is replaced by the result
+}
+
+// The ticket and campaign can be set per sample via the
+// payload of the message sent by crits.
+const (
+	payloadTicket   = "crits_ticket"
+	payloadCampaign = "crits_campaign"
+)
+
+// processTagging adds buckets derived from the results of the other
+// parsers to the sample, attaches the ticket and campaign, and sets
+// the status of the sample. Each of these steps is only done once
+// per analysis, even if the message is retried.
+func processTagging(ctx *lib.ParserContext) ([]*lib.CrtResult, error) {
+	crits := ctx.Crits
+	resMap := make(map[string]interface{})
+
+	// once reports whether a step still has to be done
+	once := func(step string) bool {
+		_, done := ctx.Done("tagging/" + step)
+		return !done
+	}
+
+	buckets := bucketsFromResults(ctx.Results)
+	if len(buckets) > 0 && once("buckets") {
+		if err := crits.AddBuckets(buckets); err != nil {
+			return []*lib.CrtResult{}, err
+		}
+		ctx.MarkDone("tagging/buckets", strings.Join(buckets, ","))
+	}
+
+	ticket := tagging.Ticket
+	if t, set := ctx.Req.Payload[payloadTicket]; set {
+		ticket = t
+	}
+
+	if ticket != "" {
+		if once("ticket") {
+			if err := crits.AddTicket(ticket); err != nil {
+				return []*lib.CrtResult{}, err
+			}
+			ctx.MarkDone("tagging/ticket", ticket)
+		}
+		resMap["ticket"] = ticket
+	}
+
+	campaign := tagging.Campaign
+	if cp, set := ctx.Req.Payload[payloadCampaign]; set {
+		campaign = cp
+	}
+
+	if campaign != "" {
+		if once("campaign") {
+			if err := crits.AddCampaign(campaign, tagging.CampaignConfidence); err != nil {
+				return []*lib.CrtResult{}, err
+			}
+			ctx.MarkDone("tagging/campaign", campaign)
+		}
+		resMap["campaign"] = campaign
+	}
+
+	if tagging.Status != "" {
+		if once("status") {
+			if err := crits.SetStatus(tagging.Status); err != nil {
+				return []*lib.CrtResult{}, err
+			}
+			ctx.MarkDone("tagging/status", tagging.Status)
+		}
+		resMap["status"] = tagging.Status
+	}
+
+	return []*lib.CrtResult{&lib.CrtResult{
+		"tags",
+		strings.Join(buckets, ", "),
+		resMap,
+	}}, nil
+}
+
+// bucketsFromResults applies the tag rules to the results.
+func bucketsFromResults(results []*lib.CrtResult) []string {
+	buckets := []string{}
+	seen := make(map[string]bool)
+
+	for _, r := range results {
+		for _, rule := range tagging.Rules {
+			if rule.Subtype != r.Subtype {
+				continue
+			}
+
+			if rule.Result != "" {
+				if match, err := path.Match(rule.Result, r.Result); err != nil || !match {
+					continue
+				}
+			}
+
+			// the bucket is configured, it mustn't be used as format
+			bucket := strings.Replace(rule.Bucket, "%s", r.Result, -1)
+
+			// crits separates buckets by comma
+			bucket = strings.TrimSpace(strings.Replace(bucket, ",", " ", -1))
+
+			if bucket != "" && !seen[bucket] {
+				seen[bucket] = true
+				buckets = append(buckets, bucket)
+			}
+		}
+	}
+
+	return buckets
+}